@@ -0,0 +1,148 @@
+package incmd5
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"hash"
+	"io"
+	"os"
+	"path"
+	"strings"
+)
+
+// ArchiveSeparator separates the key of an archive from the path of one of
+// its members in a member's key, as in "backup.zip!docs/a.txt".
+const ArchiveSeparator = "!"
+
+// archiveExts are the file name suffixes of the archives whose members are
+// hashed, matched without regard to case.
+var archiveExts = []string{".zip", ".tar", ".tar.gz", ".tgz"}
+
+// isArchive reports whether name has the suffix of a supported archive.
+func isArchive(name string) bool {
+	lower := strings.ToLower(name)
+	for _, ext := range archiveExts {
+		if strings.HasSuffix(lower, ext) {
+			return true
+		}
+	}
+	return false
+}
+
+// archiveOf returns the key of the archive that the member key belongs to,
+// or "" if key does not name an archive member. The archive is the
+// shortest prefix ending before a separator that names an archive, so
+// archive names may themselves contain the separator.
+func archiveOf(key string) string {
+	for i := 0; i < len(key); i++ {
+		j := strings.Index(key[i:], ArchiveSeparator)
+		if j < 0 {
+			break
+		}
+		i += j
+		if isArchive(key[:i]) {
+			return key[:i]
+		}
+	}
+	return ""
+}
+
+// memberSum is the digest of one archive member.
+type memberSum struct {
+	// key is the member's checksum key, including its archive's.
+	key  string
+	sum  string
+	info os.FileInfo
+}
+
+// hashMembers hashes every regular member of the archive at path, keying
+// each below archiveKey, whose suffix gives the archive type. Reads are
+// made under limit through buf. It also returns the number of member bytes
+// hashed.
+func hashMembers(path, archiveKey string, buf []byte, newHash func() hash.Hash, limit ioLimiter) ([]memberSum, int64, error) {
+	if strings.HasSuffix(strings.ToLower(archiveKey), ".zip") {
+		return hashZipMembers(path, archiveKey, buf, newHash, limit)
+	}
+	return hashTarMembers(path, archiveKey, buf, newHash, limit)
+}
+
+func hashZipMembers(path, archiveKey string, buf []byte, newHash func() hash.Hash, limit ioLimiter) ([]memberSum, int64, error) {
+	limit.acquire()
+	zr, err := zip.OpenReader(path)
+	limit.release()
+	if err != nil {
+		return nil, 0, err
+	}
+	defer zr.Close()
+
+	var members []memberSum
+	var total int64
+	for _, f := range zr.File {
+		info := f.FileInfo()
+		if !info.Mode().IsRegular() {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return nil, total, err
+		}
+		sum, n, err := readerHash(limitedReader{rc, limit}, buf, newHash())
+		rc.Close()
+		total += n
+		if err != nil {
+			return nil, total, err
+		}
+		members = append(members, memberSum{key: memberKey(archiveKey, f.Name), sum: sum, info: info})
+	}
+	return members, total, nil
+}
+
+func hashTarMembers(path, archiveKey string, buf []byte, newHash func() hash.Hash, limit ioLimiter) ([]memberSum, int64, error) {
+	limit.acquire()
+	file, err := os.Open(path)
+	limit.release()
+	if err != nil {
+		return nil, 0, err
+	}
+	defer file.Close()
+
+	var r io.Reader = limitedReader{file, limit}
+	if lower := strings.ToLower(archiveKey); strings.HasSuffix(lower, ".gz") || strings.HasSuffix(lower, ".tgz") {
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, 0, err
+		}
+		defer gz.Close()
+		r = gz
+	}
+
+	var members []memberSum
+	var total int64
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return members, total, nil
+		}
+		if err != nil {
+			return nil, total, err
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		sum, n, err := readerHash(tr, buf, newHash())
+		total += n
+		if err != nil {
+			return nil, total, err
+		}
+		members = append(members, memberSum{key: memberKey(archiveKey, hdr.Name), sum: sum, info: hdr.FileInfo()})
+	}
+}
+
+// memberKey returns the key of the member name inside the archive keyed
+// archiveKey, with the member path cleaned of any leading "./" or "/".
+func memberKey(archiveKey, name string) string {
+	name = strings.TrimPrefix(path.Clean("/"+name), "/")
+	return archiveKey + ArchiveSeparator + name
+}
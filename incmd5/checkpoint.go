@@ -0,0 +1,95 @@
+package incmd5
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+)
+
+// checkpoint records the keys a verification has confirmed, one per
+// NUL-terminated record after a first record naming the checksum file it
+// belongs to. A record cut short by a crash lacks its NUL and is ignored.
+type checkpoint struct {
+	path string
+	f    *os.File
+	err  error
+}
+
+// checkpointID identifies the checksum file at outputPath by its path,
+// size, and modification time, so that a checkpoint is never applied to a
+// file that was rewritten since.
+func checkpointID(outputPath string) (string, error) {
+	info, err := os.Stat(outputPath)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s\n%d\n%d", outputPath, info.Size(), info.ModTime().UnixNano()), nil
+}
+
+// openCheckpoint reads the keys confirmed by an earlier run from the
+// checkpoint at path if it belongs to outputPath, and opens it for
+// appending further keys. A missing checkpoint, or one left by another
+// checksum file, is started afresh.
+func openCheckpoint(path, outputPath string) (*checkpoint, map[string]bool, error) {
+	id, err := checkpointID(outputPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	done := make(map[string]bool)
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, nil, err
+	}
+	records := bytes.Split(data, []byte{0})
+	// The last element follows the final NUL and is empty or incomplete.
+	if len(records) > 1 && string(records[0]) == id {
+		for _, key := range records[1 : len(records)-1] {
+			done[string(key)] = true
+		}
+	} else {
+		done = nil
+	}
+
+	flags := os.O_WRONLY | os.O_CREATE | os.O_APPEND
+	if done == nil {
+		flags |= os.O_TRUNC
+	}
+	f, err := os.OpenFile(path, flags, 0o644)
+	if err != nil {
+		return nil, nil, err
+	}
+	if done == nil {
+		if _, err := f.WriteString(id + "\x00"); err != nil {
+			f.Close()
+			return nil, nil, err
+		}
+	} else if n := len(records[len(records)-1]); n > 0 {
+		// Drop the incomplete record so the next one starts cleanly.
+		if err := f.Truncate(int64(len(data) - n)); err != nil {
+			f.Close()
+			return nil, nil, err
+		}
+	}
+	return &checkpoint{path: path, f: f}, done, nil
+}
+
+// add records key as confirmed. The first write error is kept and
+// returned by close.
+func (c *checkpoint) add(key string) {
+	if c.err == nil {
+		_, c.err = c.f.WriteString(key + "\x00")
+	}
+}
+
+// close closes the checkpoint, deleting it if the verification it
+// records is complete.
+func (c *checkpoint) close(complete bool) error {
+	err := c.f.Close()
+	if c.err != nil {
+		err = c.err
+	}
+	if complete && err == nil {
+		err = os.Remove(c.path)
+	}
+	return err
+}
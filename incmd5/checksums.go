@@ -0,0 +1,820 @@
+package incmd5
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Checksum file formats. FormatText is the GNU coreutils layout
+// "<digest>  <path>", FormatBSD the BSD layout "MD5 (<path>) = <digest>",
+// and FormatSFV the Simple File Verification layout "<path> <CRC32>" used
+// with the crc32 algorithm.
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+	FormatBSD  = "bsd"
+	FormatSFV  = "sfv"
+)
+
+// validFormat reports whether format names a supported format.
+func validFormat(format string) bool {
+	return format == FormatText || format == FormatJSON || format == FormatBSD || format == FormatSFV
+}
+
+// Text header lines have the form "# key: value", or "; key: value" in
+// SFV files, where ';' starts a comment.
+const (
+	headerPrefix     = "# "
+	sfvHeaderPrefix  = "; "
+	headerAlgorithm  = "algorithm"
+	headerSymlinks   = "symlinks"
+	headerGenerator  = "generator"
+	headerGenerated  = "generated"
+	headerRoot       = "root"
+	symlinksFollowed = "follow"
+)
+
+// Header describes how a checksum file was produced.
+type Header struct {
+	// Algorithm names the hash used for every entry.
+	Algorithm string
+	// FollowSymlinks reports whether entries for symlinks hold the
+	// digest of their target; otherwise symlinks were skipped.
+	FollowSymlinks bool
+	// Generator, Generated and Roots describe the run that wrote the
+	// file: the tool and its version, when it ran, and the directories
+	// it scanned. They are informational and only written if Generator
+	// is set, in which case the algorithm is always written too.
+	Generator string
+	Generated time.Time
+	Roots     []string
+	// NulTerminated reports whether the lines of a text, BSD or SFV file
+	// end with NUL instead of newline, as md5sum -z writes them, so that
+	// paths are written as they are. Newline-terminated files escape
+	// paths holding a backslash, newline or carriage return the way
+	// md5sum does, with a backslash starting the line.
+	NulTerminated bool
+	// CRLF reports whether the lines of a newline-terminated text, BSD or
+	// SFV file end with a carriage return before the newline, as Windows
+	// tools expect. Reading accepts either ending, judging the file by its
+	// first line.
+	CRLF bool
+	// Binary reports whether text entries mark their path with '*', as
+	// md5sum -b writes them, rather than with a space. Both are read, and
+	// md5sum -c hashes either byte for byte on the systems this runs on;
+	// a file is judged by its first entry.
+	Binary bool
+}
+
+// eol returns the line terminator of files written with h.
+func (h Header) eol() string {
+	switch {
+	case h.NulTerminated:
+		return "\x00"
+	case h.CRLF:
+		return "\r\n"
+	}
+	return "\n"
+}
+
+// Record is the stored state of one file. Size, ModTime, Mode, HashedAt,
+// Device, Inode and Chunks are only persisted by the JSON format; the text
+// format leaves them zero.
+type Record struct {
+	Hash    string    `json:"hash"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modtime"`
+	// Mode holds the permission bits in octal, such as "0644". It is
+	// empty in files written before modes were recorded.
+	Mode string `json:"mode,omitempty"`
+	// HashedAt is when Hash was last computed from the file.
+	HashedAt time.Time `json:"hashed_at,omitzero"`
+	// Device and Inode identify the file when it was hashed, and are zero
+	// where the platform has no inode numbers. A file found under a new
+	// key with the device, inode, size and modtime of an entry, as after a
+	// rename, takes that entry's digest without being read.
+	Device uint64 `json:"device,omitempty"`
+	Inode  uint64 `json:"inode,omitempty"`
+	// Chunks is the chunk index of a large file, kept with
+	// Scanner.ChunkIndex.
+	Chunks []Chunk `json:"chunks,omitempty"`
+}
+
+func (r Record) equal(other Record) bool {
+	return r.Hash == other.Hash && r.Size == other.Size && r.ModTime.Equal(other.ModTime) &&
+		r.Mode == other.Mode && r.HashedAt.Equal(other.HashedAt) &&
+		r.Device == other.Device && r.Inode == other.Inode &&
+		slices.EqualFunc(r.Chunks, other.Chunks, Chunk.equal)
+}
+
+// permBits returns the permission bits of info in the form stored in
+// Record.Mode.
+func permBits(info os.FileInfo) string {
+	return fmt.Sprintf("%04o", info.Mode().Perm())
+}
+
+// jsonChecksums is the document written by the JSON format.
+type jsonChecksums struct {
+	Generator      string            `json:"generator,omitempty"`
+	Generated      time.Time         `json:"generated,omitzero"`
+	Roots          []string          `json:"roots,omitempty"`
+	Algorithm      string            `json:"algorithm"`
+	FollowSymlinks bool              `json:"follow_symlinks,omitempty"`
+	Files          map[string]Record `json:"files"`
+}
+
+// ReadChecksums loads the checksum file at path along with its header.
+// A path ending in .gz is decompressed first and judged by the extension
+// before it. JSON files are recognised by a .json extension or a leading
+// '{'; anything else is parsed line by line as text or BSD entries. A text
+// file without an algorithm header is assumed to be MD5, while BSD entries
+// name their algorithm themselves. Keys use forward slashes; backslashes
+// in files written by older versions on Windows are converted there.
+// Lines may end with LF or CRLF, or with NUL as md5sum -z writes them.
+//
+// A missing file yields no entries and no error. A file that exists but
+// cannot be read, or holds lines that are not entries, headers or
+// comments, yields a *CorruptError along with the entries that could be
+// parsed. A path ending in ShardSuffix is read as a directory of shards.
+func ReadChecksums(path string) (map[string]Record, Header, error) {
+	if IsSharded(path) {
+		return readShards(path)
+	}
+	r, closeFile, err := openChecksums(path)
+	if os.IsNotExist(err) {
+		return make(map[string]Record), Header{Algorithm: DefaultAlgorithm}, nil
+	}
+	if err != nil {
+		return make(map[string]Record), Header{Algorithm: DefaultAlgorithm}, &CorruptError{Path: path, Err: err}
+	}
+	defer closeFile()
+
+	var checksums map[string]Record
+	var header Header
+	if strings.EqualFold(dataExt(path), ".json") || startsWithBrace(r) {
+		checksums, header, err = readJSONChecksums(r)
+	} else {
+		checksums, header, err = readTextChecksums(r, isSFV(path))
+	}
+	if err != nil {
+		if corrupt, ok := err.(*CorruptError); ok {
+			corrupt.Path = path
+		} else {
+			err = &CorruptError{Path: path, Err: err}
+		}
+	}
+	return slashKeys(checksums), header, err
+}
+
+// CorruptError reports a checksum file that exists but could not be fully
+// read. Overwriting it would lose the entries that were not understood.
+type CorruptError struct {
+	Path string
+	// Skipped counts the lines that could not be parsed, and Line is the
+	// number of the first of them. Both are zero if the file could not
+	// be read or decoded at all.
+	Skipped int
+	Line    int
+	// Err is the read or decode error, if any.
+	Err error
+}
+
+func (e *CorruptError) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("cannot read checksum file %s: %v", e.Path, e.Err)
+	}
+	return fmt.Sprintf("checksum file %s has %d unparsable lines, the first at line %d", e.Path, e.Skipped, e.Line)
+}
+
+func (e *CorruptError) Unwrap() error {
+	return e.Err
+}
+
+// Is makes every CorruptError match ErrManifestCorrupt.
+func (e *CorruptError) Is(target error) bool {
+	return target == ErrManifestCorrupt
+}
+
+// readOrder returns the keys of the text or BSD checksum file at path in
+// the order they appear, or nil if it is JSON or cannot be opened.
+func readOrder(path string) []string {
+	r, closeFile, err := openChecksums(path)
+	if err != nil {
+		return nil
+	}
+	defer closeFile()
+	if strings.EqualFold(dataExt(path), ".json") || startsWithBrace(r) {
+		return nil
+	}
+
+	sfv := isSFV(path)
+	var order []string
+	scanner, nul := lineScanner(r)
+	for scanner.Scan() {
+		line := trimLine(scanner.Text(), nul)
+		if strings.HasPrefix(line, headerPrefix) || strings.HasPrefix(line, ";") {
+			continue
+		}
+		if _, _, key, _, ok := parseEntry(line, sfv); ok {
+			order = append(order, filepath.ToSlash(key))
+		}
+	}
+	return order
+}
+
+// slashKeys returns checksums with every key in forward-slash form. It is
+// a no-op where the separator already is a slash.
+func slashKeys(checksums map[string]Record) map[string]Record {
+	if filepath.Separator == '/' {
+		return checksums
+	}
+	slashed := make(map[string]Record, len(checksums))
+	for key, rec := range checksums {
+		slashed[filepath.ToSlash(key)] = rec
+	}
+	return slashed
+}
+
+// DetectFormat reports the format of the checksum file at path using the
+// same rules as ReadChecksums, or "" if it cannot be opened. A file ending
+// in .sfv is SFV; any other line-based file takes the format of its first
+// entry. A directory of shards takes the format of its first shard.
+func DetectFormat(path string) string {
+	if path == StdoutPath {
+		return ""
+	}
+	if IsSharded(path) {
+		files, _ := shardFiles(path)
+		if len(files) == 0 {
+			return ""
+		}
+		return DetectFormat(files[0])
+	}
+	r, closeFile, err := openChecksums(path)
+	if err != nil {
+		return ""
+	}
+	defer closeFile()
+
+	if strings.EqualFold(dataExt(path), ".json") || startsWithBrace(r) {
+		return FormatJSON
+	}
+	if isSFV(path) {
+		return FormatSFV
+	}
+	scanner, nul := lineScanner(r)
+	for scanner.Scan() {
+		line := trimLine(scanner.Text(), nul)
+		if line == "" || strings.HasPrefix(line, headerPrefix) || strings.HasPrefix(line, ";") {
+			continue
+		}
+		if format, _, _, _, ok := parseEntry(line, false); ok {
+			return format
+		}
+		break
+	}
+	return FormatText
+}
+
+// isSFV reports whether the checksum file at path is named as SFV.
+func isSFV(path string) bool {
+	return strings.EqualFold(dataExt(path), ".sfv")
+}
+
+// openChecksums opens the checksum file at path for reading, decompressing
+// it if it is gzipped, and returns a function that closes it.
+func openChecksums(path string) (*bufio.Reader, func(), error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !compressed(path) {
+		return bufio.NewReaderSize(file, 64<<10), func() { file.Close() }, nil
+	}
+	gz, err := gzip.NewReader(file)
+	if err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+	return bufio.NewReaderSize(gz, 64<<10), func() { gz.Close(); file.Close() }, nil
+}
+
+// compressed reports whether the checksum file at path is gzipped.
+func compressed(path string) bool {
+	return strings.EqualFold(filepath.Ext(path), ".gz")
+}
+
+// dataExt returns the extension of path that describes its contents,
+// looking past a .gz suffix.
+func dataExt(path string) string {
+	if compressed(path) {
+		path = path[:len(path)-len(".gz")]
+	}
+	return filepath.Ext(path)
+}
+
+// startsWithBrace reports whether the first non-whitespace byte in r is '{'
+// without consuming it.
+func startsWithBrace(r *bufio.Reader) bool {
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return false
+		}
+		if b == ' ' || b == '\t' || b == '\r' || b == '\n' {
+			continue
+		}
+		r.UnreadByte()
+		return b == '{'
+	}
+}
+
+func readJSONChecksums(r io.Reader) (map[string]Record, Header, error) {
+	var doc jsonChecksums
+	if err := json.NewDecoder(r).Decode(&doc); err != nil {
+		return make(map[string]Record), Header{Algorithm: DefaultAlgorithm}, err
+	}
+	if doc.Files == nil {
+		doc.Files = make(map[string]Record)
+	}
+	if doc.Algorithm == "" {
+		doc.Algorithm = DefaultAlgorithm
+	}
+	return doc.Files, Header{
+		Algorithm:      doc.Algorithm,
+		FollowSymlinks: doc.FollowSymlinks,
+		Generator:      doc.Generator,
+		Generated:      doc.Generated,
+		Roots:          doc.Roots,
+	}, nil
+}
+
+// readTextChecksums parses text, BSD and SFV lines, trying SFV first if
+// sfv is set. Blank lines and '#' comments are skipped; any other line
+// that is not an entry is counted in a *CorruptError.
+func readTextChecksums(r *bufio.Reader, sfv bool) (map[string]Record, Header, error) {
+	checksums := make(map[string]Record)
+	header := Header{Algorithm: DefaultAlgorithm}
+	var corrupt CorruptError
+	scanner, nul := lineScanner(r)
+	header.NulTerminated = nul
+	header.CRLF = !nul && crlfLines(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := trimLine(scanner.Text(), nul)
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, headerPrefix) {
+			header.parseLine(strings.TrimPrefix(line, headerPrefix))
+			continue
+		}
+		if strings.HasPrefix(line, ";") {
+			header.parseLine(strings.TrimPrefix(line, sfvHeaderPrefix))
+			continue
+		}
+		if format, algo, path, sum, ok := parseEntry(line, sfv); ok {
+			if algo != "" {
+				header.Algorithm = algo
+			}
+			if format == FormatText && len(checksums) == 0 {
+				_, _, header.Binary, _ = parseTextLine(strings.TrimPrefix(line, `\`))
+			}
+			checksums[path] = Record{Hash: sum}
+			continue
+		}
+		if line[0] == '#' {
+			continue
+		}
+		if corrupt.Skipped == 0 {
+			corrupt.Line = n
+		}
+		corrupt.Skipped++
+	}
+	if err := scanner.Err(); err != nil {
+		return checksums, header, err
+	}
+	if corrupt.Skipped > 0 {
+		return checksums, header, &corrupt
+	}
+	return checksums, header, nil
+}
+
+// parseEntry parses a text, BSD or SFV entry line, returning its format,
+// the algorithm it names if any, its path and its lowercase digest. SFV is
+// tried first if sfv is set and last otherwise, since its single-space
+// layout is the least specific.
+func parseEntry(line string, sfv bool) (format, algo, path, sum string, ok bool) {
+	if sfv {
+		if path, sum, ok := parseSFVLine(line); ok {
+			return FormatSFV, sfvAlgorithm, path, sum, true
+		}
+	}
+	if escaped, ok := strings.CutPrefix(line, `\`); ok {
+		if sum, path, _, ok := parseTextLine(escaped); ok {
+			return FormatText, "", unescapePath(path), sum, true
+		}
+		if algo, path, sum, ok := parseBSDLine(escaped); ok {
+			return FormatBSD, algo, unescapePath(path), sum, true
+		}
+	}
+	if sum, path, _, ok := parseTextLine(line); ok {
+		return FormatText, "", path, sum, true
+	}
+	if algo, path, sum, ok := parseBSDLine(line); ok {
+		return FormatBSD, algo, path, sum, true
+	}
+	if !sfv {
+		if path, sum, ok := parseSFVLine(line); ok {
+			return FormatSFV, sfvAlgorithm, path, sum, true
+		}
+	}
+	return "", "", "", "", false
+}
+
+// sfvAlgorithm is the only algorithm SFV files hold.
+const sfvAlgorithm = "crc32"
+
+// parseSFVLine splits a "<path> <8 hex digits>" line at its last space.
+func parseSFVLine(line string) (path, sum string, ok bool) {
+	i := strings.LastIndexByte(line, ' ')
+	if i <= 0 || len(line)-i-1 != 8 {
+		return "", "", false
+	}
+	sum = strings.ToLower(line[i+1:])
+	if _, err := hex.DecodeString(sum); err != nil {
+		return "", "", false
+	}
+	return line[:i], sum, true
+}
+
+// trimLine strips only a line's leading whitespace and, unless lines end
+// with NUL, its trailing CR, so that spaces at either end of a path
+// survive. It runs before a line is split into fields, so neither the
+// digest nor the path of a CRLF-terminated line keeps the CR; a CR that
+// belongs to a path is always escaped as \r.
+func trimLine(line string, nul bool) string {
+	if !nul {
+		line = strings.TrimSuffix(line, "\r")
+	}
+	return strings.TrimLeft(line, " \t")
+}
+
+// maxLineLength bounds the lines of a checksum file, far above the
+// longest path any file system accepts.
+const maxLineLength = 1 << 20
+
+// lineScanner returns a scanner over the lines of r, which end with NUL if
+// the bytes r has buffered hold one and with newline otherwise, and
+// reports which.
+func lineScanner(r *bufio.Reader) (*bufio.Scanner, bool) {
+	peek, _ := r.Peek(r.Size())
+	nul := bytes.IndexByte(peek, 0) >= 0
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, maxLineLength)
+	if nul {
+		scanner.Split(scanNul)
+	}
+	return scanner, nul
+}
+
+// crlfLines reports whether the first line buffered in r ends with CR LF.
+// It must be called before r is read.
+func crlfLines(r *bufio.Reader) bool {
+	peek, _ := r.Peek(r.Size())
+	i := bytes.IndexByte(peek, '\n')
+	return i > 0 && peek[i-1] == '\r'
+}
+
+// scanNul is a bufio.SplitFunc for NUL-terminated lines.
+func scanNul(data []byte, atEOF bool) (int, []byte, error) {
+	if i := bytes.IndexByte(data, 0); i >= 0 {
+		return i + 1, data[:i], nil
+	}
+	if atEOF && len(data) > 0 {
+		return len(data), data, nil
+	}
+	return 0, nil, nil
+}
+
+// pathEscaper and pathUnescaper apply the md5sum escaping of paths in
+// newline-terminated lines.
+var (
+	pathEscaper   = strings.NewReplacer(`\`, `\\`, "\n", `\n`, "\r", `\r`)
+	pathUnescaper = strings.NewReplacer(`\\`, `\`, `\n`, "\n", `\r`, "\r")
+)
+
+// unescapePath undoes the escaping of the path of a line that started with
+// a backslash.
+func unescapePath(path string) string {
+	return pathUnescaper.Replace(path)
+}
+
+// parseBSDLine splits a "<ALGO> (<path>) = <hex digest>" line. The path
+// ends at the last ") = " since the digest cannot contain one, so paths
+// may contain spaces and parentheses.
+func parseBSDLine(line string) (algo, path, sum string, ok bool) {
+	tag, rest, found := strings.Cut(line, " (")
+	if !found || tag == "" || strings.ContainsAny(tag, " \t") {
+		return "", "", "", false
+	}
+	i := strings.LastIndex(rest, ") = ")
+	if i <= 0 {
+		return "", "", "", false
+	}
+	sum = rest[i+len(") = "):]
+	if _, err := hex.DecodeString(sum); err != nil || sum == "" {
+		return "", "", "", false
+	}
+	return strings.ToLower(tag), rest[:i], sum, true
+}
+
+// parseLine applies a "key: value" text header line. Unknown keys are
+// ignored.
+func (h *Header) parseLine(line string) {
+	key, value, ok := strings.Cut(line, ":")
+	if !ok {
+		return
+	}
+	value = strings.TrimSpace(value)
+	switch strings.TrimSpace(key) {
+	case headerAlgorithm:
+		h.Algorithm = value
+	case headerSymlinks:
+		h.FollowSymlinks = value == symlinksFollowed
+	case headerGenerator:
+		h.Generator = value
+	case headerGenerated:
+		h.Generated, _ = time.Parse(time.RFC3339, value)
+	case headerRoot:
+		h.Roots = append(h.Roots, value)
+	}
+}
+
+// writeText writes the text header lines that differ from the defaults,
+// each starting with prefix, so a default MD5 file stays identical to
+// plain md5sum output. The algorithm line is left out when the entries
+// name it themselves, unless the run is described as well. GNU md5sum -c
+// skips these lines as comments.
+func (h Header) writeText(w io.Writer, prefix string, withAlgorithm bool) error {
+	if h.Generator != "" {
+		if _, err := fmt.Fprintf(w, "%s%s: %s%s%s%s: %s%s", prefix, headerGenerator, h.Generator, h.eol(),
+			prefix, headerGenerated, h.Generated.Format(time.RFC3339), h.eol()); err != nil {
+			return err
+		}
+		for _, root := range h.Roots {
+			if _, err := fmt.Fprintf(w, "%s%s: %s%s", prefix, headerRoot, root, h.eol()); err != nil {
+				return err
+			}
+		}
+		withAlgorithm = true
+	}
+	if withAlgorithm && (h.Algorithm != DefaultAlgorithm || h.Generator != "") {
+		if _, err := fmt.Fprintf(w, "%s%s: %s%s", prefix, headerAlgorithm, h.Algorithm, h.eol()); err != nil {
+			return err
+		}
+	}
+	if h.FollowSymlinks {
+		if _, err := fmt.Fprintf(w, "%s%s: %s%s", prefix, headerSymlinks, symlinksFollowed, h.eol()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseTextLine splits a "<hex digest>  <path>" line, or a binary-mode
+// "<hex digest> *<path>" line, reporting which it was. The digest may be
+// several separated by single spaces when the file holds more than one
+// algorithm. The digests run up to the first delimiter and everything
+// after it is taken literally as the path, so paths may themselves
+// contain runs of spaces or start with '*'.
+func parseTextLine(line string) (sum, path string, binary, ok bool) {
+	for _, delim := range []string{"  ", " *"} {
+		i := strings.Index(line, delim)
+		if i <= 0 || len(line) == i+2 || !hexColumns(line[:i]) {
+			continue
+		}
+		return line[:i], line[i+2:], delim == " *", true
+	}
+	return "", "", false, false
+}
+
+// hexColumns reports whether s is one or more hex digests separated by
+// single spaces.
+func hexColumns(s string) bool {
+	for _, column := range strings.Split(s, " ") {
+		if _, err := hex.DecodeString(column); err != nil || column == "" {
+			return false
+		}
+	}
+	return true
+}
+
+// WriteChecksums atomically replaces path with the header and checksums,
+// sorted by path, in the given format, gzipped if path ends in .gz. The
+// data is synced to disk before the temp file is renamed over path, and on
+// Unix the directory is synced afterwards so the rename itself survives a
+// crash. The temp file is removed if anything fails.
+func WriteChecksums(path string, checksums map[string]Record, header Header, format string) error {
+	return writeChecksums(path, checksums, header, format, nil)
+}
+
+// writeChecksums is WriteChecksums writing text and BSD entries in order:
+// first the keys of order that are still in checksums, then the remaining
+// keys sorted. A nil order sorts everything. A path ending in ShardSuffix
+// is written as a directory of shards.
+func writeChecksums(path string, checksums map[string]Record, header Header, format string, order []string) error {
+	if IsSharded(path) {
+		return writeShards(path, checksums, header, format, order)
+	}
+	paths := orderedPaths(checksums, order)
+	return writeAtomic(path, func(w io.Writer) error {
+		return encodeChecksums(w, checksums, paths, header, format)
+	})
+}
+
+// StdoutPath as an output path writes the checksum listing to standard
+// output instead of a file. Nothing is read from it, so a scan writing to
+// it hashes every file unless it keeps its entries in a database.
+const StdoutPath = "-"
+
+// writeAtomic replaces path with what encode writes, as WriteChecksums
+// describes. Standard output, at StdoutPath, is simply written to.
+func writeAtomic(path string, encode func(io.Writer) error) (err error) {
+	if path == StdoutPath {
+		w := bufio.NewWriter(os.Stdout)
+		if err := encode(w); err != nil {
+			return err
+		}
+		return w.Flush()
+	}
+	tmpPath := path + ".tmp"
+	file, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			file.Close()
+			os.Remove(tmpPath)
+		}
+	}()
+
+	var w io.Writer = file
+	var gz *gzip.Writer
+	if compressed(path) {
+		gz = gzip.NewWriter(file)
+		w = gz
+	}
+	if err := encode(w); err != nil {
+		return err
+	}
+	if gz != nil {
+		if err := gz.Close(); err != nil {
+			return err
+		}
+	}
+	if err := file.Sync(); err != nil {
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+// encodeChecksums writes checksums in format, with line-based formats
+// listing paths in the given order.
+func encodeChecksums(w io.Writer, checksums map[string]Record, paths []string, header Header, format string) error {
+	if format == FormatJSON {
+		return writeJSONChecksums(w, checksums, header)
+	}
+	if err := writeLineHeader(w, header, format); err != nil {
+		return err
+	}
+	for _, path := range paths {
+		if err := writeLine(w, path, checksums[path].Hash, header, format); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeJSONChecksums writes checksums as JSON, which cannot hold a path
+// that is not valid UTF-8 without altering it.
+func writeJSONChecksums(w io.Writer, checksums map[string]Record, header Header) error {
+	for key := range checksums {
+		if !utf8.ValidString(key) {
+			return fmt.Errorf("the JSON format cannot hold %q, which is not valid UTF-8; use a line-based format", key)
+		}
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	doc := jsonChecksums{Algorithm: header.Algorithm, FollowSymlinks: header.FollowSymlinks, Files: checksums}
+	if header.Generator != "" {
+		doc.Generator, doc.Generated, doc.Roots = header.Generator, header.Generated, header.Roots
+	}
+	return enc.Encode(doc)
+}
+
+// writeLineHeader writes the header of the text, BSD or SFV format.
+func writeLineHeader(w io.Writer, header Header, format string) error {
+	switch format {
+	case FormatBSD:
+		return header.writeText(w, headerPrefix, false)
+	case FormatSFV:
+		if _, err := fmt.Fprintf(w, "%sGenerated by incremental-md5 on %s%s", sfvHeaderPrefix, time.Now().Format(time.DateTime), header.eol()); err != nil {
+			return err
+		}
+		return header.writeText(w, sfvHeaderPrefix, false)
+	default:
+		return header.writeText(w, headerPrefix, true)
+	}
+}
+
+// writeLine writes the entry for path in the text, BSD or SFV format. SFV
+// has no escaping, so its paths are always written as they are, and one
+// with a line break is an error unless lines end in NUL.
+func writeLine(w io.Writer, path, sum string, header Header, format string) error {
+	if !header.NulTerminated && format == FormatSFV && strings.ContainsAny(path, "\n\r") {
+		return fmt.Errorf("the SFV format cannot hold %q, which has a line break; use another format", path)
+	}
+	escape := ""
+	if !header.NulTerminated && format != FormatSFV && strings.ContainsAny(path, "\\\n\r") {
+		escape, path = `\`, pathEscaper.Replace(path)
+	}
+	var err error
+	switch format {
+	case FormatBSD:
+		_, err = fmt.Fprintf(w, "%s%s (%s) = %s%s", escape, strings.ToUpper(header.Algorithm), path, sum, header.eol())
+	case FormatSFV:
+		_, err = fmt.Fprintf(w, "%s %s%s", path, strings.ToUpper(sum), header.eol())
+	default:
+		marker := " "
+		if header.Binary {
+			marker = "*"
+		}
+		_, err = fmt.Fprintf(w, "%s%s %s%s%s", escape, sum, marker, path, header.eol())
+	}
+	return err
+}
+
+// orderedPaths returns the keys of checksums, those listed in order first
+// and in that order, followed by the rest sorted.
+func orderedPaths(checksums map[string]Record, order []string) []string {
+	paths := make([]string, 0, len(checksums))
+	placed := make(map[string]bool, len(order))
+	for _, path := range order {
+		if _, ok := checksums[path]; ok && !placed[path] {
+			paths = append(paths, path)
+			placed[path] = true
+		}
+	}
+	for _, path := range sortedPaths(checksums) {
+		if !placed[path] {
+			paths = append(paths, path)
+		}
+	}
+	return paths
+}
+
+// sortedPaths returns the keys of checksums in sorted order.
+func sortedPaths(checksums map[string]Record) []string {
+	paths := make([]string, 0, len(checksums))
+	for path := range checksums {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+func mapsEqual(a, b map[string]Record) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, av := range a {
+		if bv, exists := b[k]; !exists || !bv.equal(av) {
+			return false
+		}
+	}
+	return true
+}
+
+func fileExistsInChecksums(path string, checksums map[string]Record) bool {
+	_, exists := checksums[path]
+	return exists
+}
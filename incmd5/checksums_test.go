@@ -0,0 +1,363 @@
+package incmd5
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadChecksumsCRLF(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "md5sums.txt")
+	data := "# algorithm: md5\r\n" +
+		"d41d8cd98f00b204e9800998ecf8427e  empty.txt\r\n" +
+		"b1946ac92492d2347c6235b4d2611184 *sub/hello.txt\r\n" +
+		"MD5 (bsd name.txt) = 5d41402abc4b2a76b9719d911017c592\r\n"
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	checksums, header, err := ReadChecksums(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"empty.txt":     "d41d8cd98f00b204e9800998ecf8427e",
+		"sub/hello.txt": "b1946ac92492d2347c6235b4d2611184",
+		"bsd name.txt":  "5d41402abc4b2a76b9719d911017c592",
+	}
+	if len(checksums) != len(want) {
+		t.Errorf("got %d entries, want %d: %q", len(checksums), len(want), checksums)
+	}
+	for key, rec := range checksums {
+		if strings.Contains(key, "\r") || strings.Contains(rec.Hash, "\r") {
+			t.Errorf("entry %q = %q keeps a carriage return", key, rec.Hash)
+		}
+		if rec.Hash != want[key] {
+			t.Errorf("%q = %q, want %q", key, rec.Hash, want[key])
+		}
+	}
+	if !header.CRLF {
+		t.Error("header.CRLF = false for a CRLF-terminated file")
+	}
+	if header.Algorithm != "md5" {
+		t.Errorf("header.Algorithm = %q, want md5", header.Algorithm)
+	}
+}
+
+func TestTextMarkers(t *testing.T) {
+	const sum = "b1946ac92492d2347c6235b4d2611184"
+	tests := []struct {
+		binary bool
+		line   string
+	}{
+		{false, sum + "  hello.txt\n"},
+		{true, sum + " *hello.txt\n"},
+	}
+	for _, tt := range tests {
+		var buf strings.Builder
+		if err := writeLine(&buf, "hello.txt", sum, Header{Binary: tt.binary}, FormatText); err != nil {
+			t.Fatal(err)
+		}
+		if buf.String() != tt.line {
+			t.Errorf("binary=%v: wrote %q, want %q", tt.binary, buf.String(), tt.line)
+		}
+		gotSum, gotPath, gotBinary, ok := parseTextLine(strings.TrimSuffix(tt.line, "\n"))
+		if !ok || gotSum != sum || gotPath != "hello.txt" || gotBinary != tt.binary {
+			t.Errorf("parseTextLine(%q) = %q, %q, %v, %v", tt.line, gotSum, gotPath, gotBinary, ok)
+		}
+	}
+}
+
+func TestBinaryMarkerMd5sum(t *testing.T) {
+	md5sum, err := exec.LookPath("md5sum")
+	if err != nil {
+		t.Skip("md5sum not found")
+	}
+	for _, binary := range []bool{true, false} {
+		dir := t.TempDir()
+		writeFiles(t, dir, map[string]string{"hello.txt": "hello\n", "sub/two  spaces": "x", "*star": "y"})
+		output := filepath.Join(dir, "md5sums.txt")
+		s := &Scanner{Output: output, BinaryMarker: binary}
+		if _, err := s.Scan(dir); err != nil {
+			t.Fatal(err)
+		}
+		cmd := exec.Command(md5sum, "-c", "--strict", output)
+		cmd.Dir = dir
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Errorf("binary=%v: md5sum -c failed: %v\n%s", binary, err, out)
+		}
+		checksums, header, err := ReadChecksums(output)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if header.Binary != binary || len(checksums) != 3 {
+			t.Errorf("binary=%v: read back Binary=%v with %d entries", binary, header.Binary, len(checksums))
+		}
+	}
+}
+
+func TestRoundTripSpaces(t *testing.T) {
+	keys := []string{
+		"my  file.txt",
+		" leading.txt",
+		"  two leading.txt",
+		"trailing.txt ",
+		"dir/a  b/c.txt",
+		"*starred.txt",
+	}
+	tests := []struct {
+		format string
+		header Header
+	}{
+		{FormatText, Header{}},
+		{FormatText, Header{Binary: true}},
+		{FormatBSD, Header{}},
+	}
+	for _, tt := range tests {
+		for _, key := range keys {
+			path := filepath.Join(t.TempDir(), "md5sums.txt")
+			tt.header.Algorithm = "md5"
+			want := map[string]Record{key: {Hash: "d41d8cd98f00b204e9800998ecf8427e"}}
+			if err := WriteChecksums(path, want, tt.header, tt.format); err != nil {
+				t.Fatal(err)
+			}
+			got, _, err := ReadChecksums(path)
+			if err != nil {
+				t.Fatalf("%s %q: %v", tt.format, key, err)
+			}
+			if !mapsEqual(got, want) {
+				t.Errorf("%s binary=%v: wrote %q, read back %q", tt.format, tt.header.Binary, want, got)
+			}
+		}
+	}
+}
+
+func TestWriteAtomic(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "md5sums.txt")
+	checksums := make(map[string]Record)
+	for i := 0; i < 1000; i++ {
+		checksums[fmt.Sprintf("dir/file%04d.txt", i)] = Record{Hash: "d41d8cd98f00b204e9800998ecf8427e"}
+	}
+	if err := WriteChecksums(path, checksums, Header{Algorithm: "md5"}, FormatText); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("temp file left behind: %v", err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(string(data), "\n"); n != len(checksums) {
+		t.Errorf("wrote %d lines, want %d", n, len(checksums))
+	}
+
+	// A failed write leaves the file as it was and removes the temp file.
+	failure := errors.New("encode failed")
+	err = writeAtomic(path, func(w io.Writer) error {
+		io.WriteString(w, "partial")
+		return failure
+	})
+	if !errors.Is(err, failure) {
+		t.Errorf("got %v, want the encode error", err)
+	}
+	if after, _ := os.ReadFile(path); string(after) != string(data) {
+		t.Error("failed write changed the checksum file")
+	}
+	if _, err := os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("temp file left behind after a failed write: %v", err)
+	}
+}
+
+func TestGzipRoundTrip(t *testing.T) {
+	modTime := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	for _, name := range []string{"md5sums.txt.gz", "md5sums.json.gz"} {
+		format := FormatText
+		if strings.HasSuffix(name, ".json.gz") {
+			format = FormatJSON
+		}
+		want := make(map[string]Record)
+		for i := 0; i < 5000; i++ {
+			rec := Record{Hash: fmt.Sprintf("%032x", i)}
+			if format == FormatJSON {
+				rec.Size, rec.ModTime = int64(i), modTime
+			}
+			want[fmt.Sprintf("dir%d/file %d.txt", i%10, i)] = rec
+		}
+		path := filepath.Join(t.TempDir(), name)
+		if err := WriteChecksums(path, want, Header{Algorithm: "md5"}, format); err != nil {
+			t.Fatal(err)
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(data) < 2 || data[0] != 0x1f || data[1] != 0x8b {
+			t.Errorf("%s is not gzipped", name)
+		}
+		if got := DetectFormat(path); got != format {
+			t.Errorf("DetectFormat(%s) = %s, want %s", name, got, format)
+		}
+		got, _, err := ReadChecksums(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !mapsEqual(got, want) {
+			t.Errorf("%s: read back %d entries that differ from the %d written", name, len(got), len(want))
+		}
+	}
+}
+
+func TestSlashSeparatedKeys(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{"sub/deep/file.txt": "x"})
+	output := filepath.Join(dir, "md5sums.txt")
+	s := &Scanner{Output: output}
+	if _, err := s.Scan(dir); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), "  sub/deep/file.txt\n") {
+		t.Errorf("checksum file does not key the file with slashes:\n%s", data)
+	}
+	checksums, _, err := ReadChecksums(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := checksums["sub/deep/file.txt"]; !ok {
+		t.Errorf("read back %q, want sub/deep/file.txt", keys(checksums))
+	}
+	res, err := s.Verify(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !res.OK() {
+		t.Errorf("verify found slash-separated keys wanting: %+v", res)
+	}
+
+	r := root{dir: dir}
+	native := filepath.Join("sub", "deep", "file.txt")
+	if got := r.key(native); got != "sub/deep/file.txt" {
+		t.Errorf("key(%q) = %q, want sub/deep/file.txt", native, got)
+	}
+	if got, want := joinRoot(r, "sub/deep/file.txt"), filepath.Join(dir, native); got != want {
+		t.Errorf("joinRoot = %q, want %q", got, want)
+	}
+	read := slashKeys(map[string]Record{native: {Hash: "00"}})
+	if _, ok := read["sub/deep/file.txt"]; !ok {
+		t.Errorf("slashKeys kept %q", keys(read))
+	}
+}
+
+func TestRoundTripUnusualBytes(t *testing.T) {
+	keys := []string{
+		"new\nline.txt",
+		"carriage\rreturn.txt",
+		`back\slash.txt`,
+		"invalid \xff\xfe utf-8.txt",
+	}
+	tests := []struct {
+		format string
+		nul    bool
+	}{
+		{FormatText, false},
+		{FormatText, true},
+		{FormatBSD, false},
+		{FormatBSD, true},
+	}
+	for _, tt := range tests {
+		path := filepath.Join(t.TempDir(), "md5sums.txt")
+		want := make(map[string]Record)
+		for _, key := range keys {
+			want[key] = Record{Hash: "d41d8cd98f00b204e9800998ecf8427e"}
+		}
+		if err := WriteChecksums(path, want, Header{Algorithm: "md5", NulTerminated: tt.nul}, tt.format); err != nil {
+			t.Fatal(err)
+		}
+		got, header, err := ReadChecksums(path)
+		if err != nil {
+			t.Fatalf("%s nul=%v: %v", tt.format, tt.nul, err)
+		}
+		if !mapsEqual(got, want) {
+			t.Errorf("%s nul=%v: wrote %q, read back %q", tt.format, tt.nul, keys, got)
+		}
+		if header.NulTerminated != tt.nul {
+			t.Errorf("%s: read NulTerminated = %v, want %v", tt.format, header.NulTerminated, tt.nul)
+		}
+	}
+
+	// JSON cannot hold invalid UTF-8 without altering it.
+	path := filepath.Join(t.TempDir(), "md5sums.json")
+	err := WriteChecksums(path, map[string]Record{keys[3]: {Hash: "00"}}, Header{Algorithm: "md5"}, FormatJSON)
+	if err == nil {
+		t.Error("JSON accepted a key that is not valid UTF-8")
+	}
+}
+
+func TestScanUnusualNames(t *testing.T) {
+	dir := t.TempDir()
+	names := []string{"new\nline.txt", "invalid \xff\xfe utf-8.txt"}
+	for _, name := range names {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(name), 0644); err != nil {
+			t.Skipf("cannot create %q: %v", name, err)
+		}
+	}
+	s := &Scanner{Output: filepath.Join(dir, "md5sums.txt"), VerifyOutput: true}
+	if _, err := s.Scan(dir); err != nil {
+		t.Fatal(err)
+	}
+	res, err := s.Scan(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Changed || len(res.Checksums) != len(names) {
+		t.Errorf("second scan changed %v with entries %q", res.Changed, keys(res.Checksums))
+	}
+}
+
+func TestScanCRLF(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{"a.txt": "a", "sub/b.txt": "b"})
+	for _, format := range []string{FormatText, FormatBSD} {
+		output := filepath.Join(t.TempDir(), "md5sums.txt")
+		s := &Scanner{Output: output, Format: format, CRLF: true, NoTimestamp: true}
+		if _, err := s.Scan(dir); err != nil {
+			t.Fatal(err)
+		}
+		data, err := os.ReadFile(output)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if lines := strings.Count(string(data), "\n"); lines == 0 || strings.Count(string(data), "\r\n") != lines {
+			t.Errorf("%s: not every line ends in CR LF: %q", format, data)
+		}
+		checksums, header, err := ReadChecksums(output)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !header.CRLF {
+			t.Errorf("%s: header.CRLF = false", format)
+		}
+		for key := range checksums {
+			if strings.Contains(key, "\r") {
+				t.Errorf("%s: key %q keeps a carriage return", format, key)
+			}
+		}
+		res, err := s.Verify(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !res.OK() {
+			t.Errorf("%s: CRLF checksum file did not verify: %+v", format, res)
+		}
+	}
+}
@@ -0,0 +1,215 @@
+package incmd5
+
+import (
+	"bytes"
+	"encoding"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+
+	"github.com/cespare/xxhash/v2"
+)
+
+// DefaultChunkMinSize is the size from which a Scanner with ChunkIndex set
+// keeps a chunk index for a file when it sets no ChunkMinSize. Smaller
+// files are hashed whole quickly enough.
+const DefaultChunkMinSize = 256 << 20
+
+// Chunk is one entry of the chunk index kept for a large file with
+// Scanner.ChunkIndex. The chunks of an index follow one another from the
+// start of the file.
+type Chunk struct {
+	// Length is the size of the chunk in bytes.
+	Length int64 `json:"length"`
+	// Sum is the xxHash64 of the chunk's bytes in hex, by which a later
+	// scan tells whether the chunk changed.
+	Sum string `json:"sum"`
+	// State is the state of the file's hash after the chunk, from which
+	// hashing resumes as long as nothing up to the chunk's end changed.
+	State []byte `json:"state"`
+}
+
+func (c Chunk) equal(other Chunk) bool {
+	return c.Length == other.Length && c.Sum == other.Sum && bytes.Equal(c.State, other.State)
+}
+
+// Chunk boundaries depend on the content: a chunk ends once a gear hash of
+// its last 64 bytes has its top chunkMaskBits bits clear, but not before
+// chunkMinLength bytes and at chunkMaxLength bytes at the latest, so that
+// an insertion or deletion only moves the boundaries near it. Skipping
+// the gear hash over the first chunkMinLength bytes of a chunk keeps it
+// from costing as much as the file's hash. Indexes made with other values
+// never match, and are replaced the next time their file is hashed.
+var (
+	chunkMinLength int64 = 16 << 20
+	chunkMaxLength int64 = 64 << 20
+	chunkMaskBits        = 22
+)
+
+// gear holds a fixed pseudo-random value for each byte, from splitmix64
+// with a fixed seed, so that chunk boundaries stay put across runs.
+var gear = func() (table [256]uint64) {
+	x := uint64(0)
+	for i := range table {
+		x += 0x9e3779b97f4a7c15
+		z := x
+		z = (z ^ z>>30) * 0xbf58476d1ce4e5b9
+		z = (z ^ z>>27) * 0x94d049bb133111eb
+		table[i] = z ^ z>>31
+	}
+	return table
+}()
+
+// resumable reports whether the state of h can be saved in a chunk index
+// and restored from it.
+func resumable(h hash.Hash) bool {
+	_, saves := h.(encoding.BinaryMarshaler)
+	_, restores := h.(encoding.BinaryUnmarshaler)
+	return saves && restores
+}
+
+// chunkedSum is the outcome of chunkedHash.
+type chunkedSum struct {
+	sum    string
+	chunks []Chunk
+	// length is the size of the file as read, and read the number of
+	// bytes read, which counts those of a changed chunk twice.
+	length, read int64
+	// resumed is the number of bytes only checksummed, because the hash
+	// resumed after them from the index.
+	resumed int64
+}
+
+// chunkedHash hashes the file at path with h, which must be resumable,
+// and returns its digest and chunk index. While the chunks the file
+// starts with match those of prev, the index of its entry, they are only
+// checksummed; at the first chunk that differs, h takes the state stored
+// after the chunk before it and the file is hashed from there on as
+// fileHash would, the changed chunk being read again. The open and every
+// read are made under limit.
+func chunkedHash(path string, buf []byte, h hash.Hash, prev []Chunk, limit ioLimiter) (chunkedSum, error) {
+	limit.acquire()
+	file, err := os.Open(path)
+	limit.release()
+	if err != nil {
+		return chunkedSum{}, err
+	}
+	defer file.Close()
+
+	// A chunk whose state cannot be restored ends the usable index.
+	for i, c := range prev {
+		if err := h.(encoding.BinaryUnmarshaler).UnmarshalBinary(c.State); err != nil {
+			prev = prev[:i]
+			break
+		}
+	}
+	h.Reset()
+
+	var res chunkedSum
+	r := limitedReader{file, limit}
+	x := xxhash.New()
+	mask := (uint64(1)<<chunkMaskBits - 1) << (64 - chunkMaskBits)
+	var fp uint64
+	// start is the offset of the current chunk and length the bytes read
+	// of it so far. matching reports that every chunk before it is in
+	// prev, and h has not been written to.
+	var start, length int64
+	matching := len(prev) > 0
+	// end closes the current chunk, reporting whether it differs from
+	// prev, in which case the file has been rewound to read it again.
+	end := func() (bool, error) {
+		sum := fmt.Sprintf("%016x", x.Sum64())
+		i := len(res.chunks)
+		x.Reset()
+		fp = 0
+		defer func() { length = 0 }()
+		if matching {
+			if i < len(prev) && prev[i].Length == length && prev[i].Sum == sum {
+				res.chunks = append(res.chunks, prev[i])
+				res.resumed += length
+				start += length
+				return false, nil
+			}
+			matching = false
+			if err := resume(h, res.chunks); err != nil {
+				return false, err
+			}
+			_, err := file.Seek(start, io.SeekStart)
+			return true, err
+		}
+		state, err := h.(encoding.BinaryMarshaler).MarshalBinary()
+		if err != nil {
+			return false, err
+		}
+		res.chunks = append(res.chunks, Chunk{Length: length, Sum: sum, State: state})
+		start += length
+		return false, nil
+	}
+
+read:
+	for {
+		n, readErr := r.Read(buf)
+		res.read += int64(n)
+		p := buf[:n]
+		for len(p) > 0 {
+			cut, boundary := len(p), false
+			if skip := chunkMinLength - length; skip > 0 {
+				cut = int(min(skip, int64(len(p))))
+			} else {
+				for i, b := range p {
+					fp = fp<<1 + gear[b]
+					if fp&mask == 0 || length+int64(i+1) >= chunkMaxLength {
+						cut, boundary = i+1, true
+						break
+					}
+				}
+			}
+			x.Write(p[:cut])
+			if !matching {
+				h.Write(p[:cut])
+			}
+			p = p[cut:]
+			length += int64(cut)
+			if !boundary {
+				continue
+			}
+			if restart, err := end(); err != nil {
+				return res, err
+			} else if restart {
+				continue read
+			}
+		}
+		switch {
+		case readErr == io.EOF && length > 0:
+			if restart, err := end(); err != nil {
+				return res, err
+			} else if restart {
+				continue read
+			}
+			break read
+		case readErr == io.EOF:
+			break read
+		case readErr != nil:
+			return res, readErr
+		}
+	}
+	if matching {
+		if err := resume(h, res.chunks); err != nil {
+			return res, err
+		}
+	}
+	res.length = start
+	res.sum = digest(h)
+	return res, nil
+}
+
+// resume sets h to the state stored after the last of chunks, or resets
+// it if there are none.
+func resume(h hash.Hash, chunks []Chunk) error {
+	h.Reset()
+	if len(chunks) == 0 {
+		return nil
+	}
+	return h.(encoding.BinaryUnmarshaler).UnmarshalBinary(chunks[len(chunks)-1].State)
+}
@@ -0,0 +1,179 @@
+package incmd5
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+// smallChunks shrinks chunks to a few KiB until the test ends.
+func smallChunks(t *testing.T) {
+	t.Helper()
+	minLength, maxLength, maskBits := chunkMinLength, chunkMaxLength, chunkMaskBits
+	chunkMinLength, chunkMaxLength, chunkMaskBits = 2<<10, 16<<10, 11
+	t.Cleanup(func() { chunkMinLength, chunkMaxLength, chunkMaskBits = minLength, maxLength, maskBits })
+}
+
+func TestChunkedHash(t *testing.T) {
+	smallChunks(t)
+	rng := rand.New(rand.NewSource(1))
+	original := make([]byte, 200<<10)
+	rng.Read(original)
+	edit := func(f func(data []byte) []byte) []byte {
+		return f(slices.Clone(original))
+	}
+	// minResumed and maxResumed bound how much of each version is only
+	// checksummed against the index of the original.
+	tests := []struct {
+		name                   string
+		data                   []byte
+		minResumed, maxResumed int
+	}{
+		{"unchanged", original, len(original), len(original)},
+		{"changed near the end", edit(func(d []byte) []byte { d[len(d)-100] ^= 1; return d }), len(original) - 16<<10, len(original)},
+		{"changed at the start", edit(func(d []byte) []byte { d[0] ^= 1; return d }), 0, 0},
+		{"inserted into", edit(func(d []byte) []byte { return slices.Insert(d, 150<<10, []byte("inserted")...) }), 100 << 10, 150 << 10},
+		{"appended to", edit(func(d []byte) []byte { return append(d, "appended"...) }), len(original) - 16<<10, len(original)},
+		{"truncated", original[:120<<10], 100 << 10, 120 << 10},
+		{"emptied", nil, 0, 0},
+	}
+	for _, algo := range []string{"md5", "sha256", "crc32", "xxhash64"} {
+		newHash := HashAlgorithms[algo]
+		path := filepath.Join(t.TempDir(), "file")
+		if err := os.WriteFile(path, original, 0644); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, 4<<10)
+		index, err := chunkedHash(path, buf, newHash(), nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want, _ := FileHash(path, buf, newHash()); index.sum != want {
+			t.Fatalf("%s: digest %s, want %s", algo, index.sum, want)
+		}
+		if len(index.chunks) < 10 || index.resumed != 0 {
+			t.Fatalf("%s: %d chunks, %d bytes resumed without an index", algo, len(index.chunks), index.resumed)
+		}
+
+		for _, tt := range tests {
+			if err := os.WriteFile(path, tt.data, 0644); err != nil {
+				t.Fatal(err)
+			}
+			got, err := chunkedHash(path, buf, newHash(), index.chunks, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			fresh, err := chunkedHash(path, buf, newHash(), nil, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want, _ := FileHash(path, buf, newHash()); got.sum != want {
+				t.Errorf("%s, %s: digest %s, want %s", algo, tt.name, got.sum, want)
+			}
+			if !slices.EqualFunc(got.chunks, fresh.chunks, Chunk.equal) {
+				t.Errorf("%s, %s: index differs from one built from scratch", algo, tt.name)
+			}
+			if got.resumed < int64(tt.minResumed) || got.resumed > int64(tt.maxResumed) {
+				t.Errorf("%s, %s: resumed %d bytes, want %d to %d", algo, tt.name, got.resumed, tt.minResumed, tt.maxResumed)
+			}
+			if got.length != int64(len(tt.data)) {
+				t.Errorf("%s, %s: length %d, want %d", algo, tt.name, got.length, len(tt.data))
+			}
+		}
+	}
+}
+
+func TestChunkedHashBadState(t *testing.T) {
+	smallChunks(t)
+	data := make([]byte, 100<<10)
+	rand.New(rand.NewSource(2)).Read(data)
+	path := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4<<10)
+	index, err := chunkedHash(path, buf, md5.New(), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The index only helps up to the chunk whose state is unusable.
+	chunks := slices.Clone(index.chunks)
+	chunks[3].State = []byte("garbage")
+	got, err := chunkedHash(path, buf, md5.New(), chunks, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := md5.Sum(data)
+	if want := hex.EncodeToString(sum[:]); got.sum != want {
+		t.Errorf("digest %s, want %s", got.sum, want)
+	}
+	if want := chunks[0].Length + chunks[1].Length + chunks[2].Length; got.resumed != want {
+		t.Errorf("resumed %d bytes, want %d", got.resumed, want)
+	}
+}
+
+func TestScanChunkIndex(t *testing.T) {
+	smallChunks(t)
+	dir := t.TempDir()
+	data := make([]byte, 200<<10)
+	rand.New(rand.NewSource(3)).Read(data)
+	big := filepath.Join(dir, "big.bin")
+	if err := os.WriteFile(big, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	writeFiles(t, dir, map[string]string{"small.txt": "small"})
+	output := filepath.Join(t.TempDir(), "sums.json")
+	s := &Scanner{Output: output, ChunkIndex: true, ChunkMinSize: 64 << 10}
+	res, err := s.Scan(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Checksums["big.bin"].Chunks) == 0 || len(res.Checksums["small.txt"].Chunks) > 0 {
+		t.Errorf("indexed %d chunks of big.bin and %d of small.txt, want some and none",
+			len(res.Checksums["big.bin"].Chunks), len(res.Checksums["small.txt"].Chunks))
+	}
+
+	data[len(data)-100] ^= 1
+	if err := os.WriteFile(big, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Hour)
+	if err := os.Chtimes(big, later, later); err != nil {
+		t.Fatal(err)
+	}
+	res, err = s.Scan(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"big.bin"}; !slices.Equal(res.Modified, want) {
+		t.Errorf("modified %q, want %q", res.Modified, want)
+	}
+	sum := md5.Sum(data)
+	if got, want := res.Checksums["big.bin"].Hash, hex.EncodeToString(sum[:]); got != want {
+		t.Errorf("digest %s, want %s", got, want)
+	}
+	if res.BytesResumed < int64(len(data))/2 || res.BytesResumed >= res.BytesHashed {
+		t.Errorf("resumed %d of %d bytes hashed", res.BytesResumed, res.BytesHashed)
+	}
+	checksums, _, err := ReadChecksums(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !checksums["big.bin"].equal(res.Checksums["big.bin"]) {
+		t.Errorf("the chunk index did not survive being written and read back")
+	}
+
+	for _, s := range []*Scanner{
+		{Output: filepath.Join(t.TempDir(), "sums.txt"), ChunkIndex: true},
+		{Output: filepath.Join(t.TempDir(), "sums.json"), ChunkIndex: true, Algorithm: "blake3"},
+	} {
+		if _, err := s.Scan(dir); err == nil {
+			t.Errorf("%s with %q: no error", s.Output, s.Algorithm)
+		}
+	}
+}
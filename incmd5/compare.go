@@ -0,0 +1,38 @@
+package incmd5
+
+// Comparison lists how one set of checksums differs from a reference set.
+// Every slice is sorted.
+type Comparison struct {
+	// Differ lists keys present in both whose digests differ.
+	Differ []string
+	// Added lists keys missing from the reference.
+	Added []string
+	// Removed lists keys only the reference has.
+	Removed []string
+}
+
+// Equal reports whether the two sets hold the same keys and digests.
+func (c Comparison) Equal() bool {
+	return len(c.Differ) == 0 && len(c.Added) == 0 && len(c.Removed) == 0
+}
+
+// Compare reports the differences of current relative to baseline. Only
+// digests are compared; sizes, modtimes and modes are ignored.
+func Compare(baseline, current map[string]Record) Comparison {
+	var c Comparison
+	for _, path := range sortedPaths(current) {
+		base, ok := baseline[path]
+		switch {
+		case !ok:
+			c.Added = append(c.Added, path)
+		case base.Hash != current[path].Hash:
+			c.Differ = append(c.Differ, path)
+		}
+	}
+	for _, path := range sortedPaths(baseline) {
+		if _, ok := current[path]; !ok {
+			c.Removed = append(c.Removed, path)
+		}
+	}
+	return c
+}
@@ -0,0 +1,506 @@
+package incmd5
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"hash"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+// dbSchema creates the tables of a checksum database. Each row of
+// checksums is one entry; seen holds the id of the last scan that visited
+// it, so that rows no scan reached can be pruned without holding every key
+// in memory. meta holds the header.
+const dbSchema = `
+CREATE TABLE IF NOT EXISTS meta (
+	key   TEXT PRIMARY KEY,
+	value TEXT NOT NULL
+);
+CREATE TABLE IF NOT EXISTS checksums (
+	path      TEXT PRIMARY KEY,
+	hash      TEXT NOT NULL,
+	size      INTEGER NOT NULL,
+	mtime     INTEGER NOT NULL,
+	mode      TEXT NOT NULL,
+	hashed_at INTEGER NOT NULL,
+	seen      INTEGER NOT NULL DEFAULT 0
+);
+CREATE INDEX IF NOT EXISTS checksums_seen ON checksums (seen);
+`
+
+// openDatabase opens the SQLite checksum database at path, creating it if
+// needed.
+func openDatabase(path string) (*sql.DB, error) {
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, err
+	}
+	// One connection keeps the scan's transaction and its lookups on the
+	// same view of the data.
+	db.SetMaxOpenConns(1)
+	for _, stmt := range []string{"PRAGMA journal_mode = WAL", "PRAGMA busy_timeout = 5000", dbSchema} {
+		if _, err := db.Exec(stmt); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("cannot open database %s: %w", path, err)
+		}
+	}
+	return db, nil
+}
+
+// dbQuerier is the part of *sql.DB and *sql.Tx used to read a database.
+type dbQuerier interface {
+	QueryRow(query string, args ...any) *sql.Row
+	Query(query string, args ...any) (*sql.Rows, error)
+}
+
+// readDBHeader returns the header stored in db, with DefaultAlgorithm if
+// none was stored.
+func readDBHeader(db dbQuerier) (Header, error) {
+	header := Header{Algorithm: DefaultAlgorithm}
+	rows, err := db.Query("SELECT key, value FROM meta")
+	if err != nil {
+		return header, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var key, value string
+		if err := rows.Scan(&key, &value); err != nil {
+			return header, err
+		}
+		switch key {
+		case headerAlgorithm:
+			header.Algorithm = value
+		case headerSymlinks:
+			header.FollowSymlinks = value == symlinksFollowed
+		}
+	}
+	return header, rows.Err()
+}
+
+// scanRecord reads a record from the hash, size, mtime, mode and hashed_at
+// columns of row, after the columns read into prefix.
+func scanRecord(row interface{ Scan(...any) error }, prefix ...any) (Record, error) {
+	var rec Record
+	var mtime, hashedAt int64
+	if err := row.Scan(append(prefix, &rec.Hash, &rec.Size, &mtime, &rec.Mode, &hashedAt)...); err != nil {
+		return Record{}, err
+	}
+	rec.ModTime = time.Unix(0, mtime)
+	if hashedAt != 0 {
+		rec.HashedAt = time.Unix(0, hashedAt)
+	}
+	return rec, nil
+}
+
+// ReadDatabase loads every entry of the SQLite checksum database at path
+// along with its header. Unlike a scan, this holds the whole table in
+// memory.
+func ReadDatabase(path string) (map[string]Record, Header, error) {
+	if _, err := os.Stat(path); err != nil {
+		return nil, Header{}, err
+	}
+	db, err := openDatabase(path)
+	if err != nil {
+		return nil, Header{}, err
+	}
+	defer db.Close()
+	header, err := readDBHeader(db)
+	if err != nil {
+		return nil, header, err
+	}
+	rows, err := db.Query("SELECT path, hash, size, mtime, mode, hashed_at FROM checksums")
+	if err != nil {
+		return nil, header, err
+	}
+	defer rows.Close()
+	checksums := make(map[string]Record)
+	for rows.Next() {
+		var key string
+		rec, err := scanRecord(rows, &key)
+		if err != nil {
+			return nil, header, err
+		}
+		checksums[key] = rec
+	}
+	return checksums, header, rows.Err()
+}
+
+// ExportDatabase writes the entries of the SQLite checksum database at
+// dbPath to the checksum file at path in format, or in the format implied
+// by path if format is empty, for tools that read the text formats.
+func ExportDatabase(dbPath, path, format string) error {
+	checksums, header, err := ReadDatabase(dbPath)
+	if err != nil {
+		return err
+	}
+	format = (&Scanner{Format: format}).format(path)
+	if !validFormat(format) {
+		return fmt.Errorf("unsupported format: %s", format)
+	}
+	if format == FormatSFV && header.Algorithm != sfvAlgorithm {
+		return fmt.Errorf("the sfv format holds %s checksums, not %s", sfvAlgorithm, header.Algorithm)
+	}
+	if format == FormatBSD && strings.Contains(header.Algorithm, AlgorithmSeparator) {
+		return fmt.Errorf("the bsd format names one algorithm per entry, not %s", header.Algorithm)
+	}
+	if format != FormatJSON {
+		for key, rec := range checksums {
+			checksums[key] = Record{Hash: rec.Hash}
+		}
+	}
+	return writeChecksums(path, checksums, header, format, nil)
+}
+
+// checkDatabaseOptions rejects the options the database backend does not
+// implement.
+func (s *Scanner) checkDatabaseOptions() error {
+	for _, opt := range []struct {
+		set  bool
+		name string
+	}{
+		{s.Archives, "archive members"},
+		{s.PerDir, "per-directory files"},
+		{s.DetectRenames, "rename detection"},
+		{s.StableOrder, "stable order"},
+		{s.CaseInsensitive, "case-insensitive paths"},
+		{s.WriteHeader, "headers"},
+		{s.Format != "", "formats"},
+		{s.VerifyOutput, "output verification"},
+		{s.DeleteEmpty, "deleting an empty output"},
+	} {
+		if opt.set {
+			return fmt.Errorf("the database backend does not support %s", opt.name)
+		}
+	}
+	return nil
+}
+
+// dbSidecars are the suffixes of the files SQLite keeps next to a
+// database, which a scan must not hash.
+var dbSidecars = []string{"", "-wal", "-shm", "-journal"}
+
+// scanDatabase is ScanDirsContext for the SQLite database at s.Database.
+// Each file is looked up by key as the walk reaches it instead of loading
+// every entry first, and all changes are made in one transaction that is
+// rolled back for a dry run, when nothing changed, or when FailOnError
+// or FailFast applies. Rows the walk did not reach are found by their seen
+// mark and pruned. Records always carry size and modtime, so the
+// timestamp file is neither read nor advanced. Result.Checksums is left
+// nil.
+func (s *Scanner) scanDatabase(ctx context.Context, roots []root, algo string, newHash func() hash.Hash) (Result, error) {
+	dbPath, err := filepath.Abs(s.Database)
+	if err != nil {
+		return Result{}, fmt.Errorf("invalid database path: %w", err)
+	}
+	db, err := openDatabase(dbPath)
+	if err != nil {
+		return Result{}, err
+	}
+	defer db.Close()
+	// The transaction outlives ctx so that an interrupted scan can still
+	// save what it hashed.
+	tx, err := db.BeginTx(context.Background(), nil)
+	if err != nil {
+		return Result{}, err
+	}
+	committed := false
+	defer func() {
+		if !committed {
+			tx.Rollback()
+		}
+	}()
+
+	existingHeader, err := readDBHeader(tx)
+	if err != nil {
+		return Result{}, err
+	}
+	var count int
+	if err := tx.QueryRow("SELECT COUNT(*) FROM checksums").Scan(&count); err != nil {
+		return Result{}, err
+	}
+	changed := false
+	if count > 0 && existingHeader.Algorithm != algo {
+		s.logf("WARNING: %s was written with %s, recomputing all entries with %s", dbPath, existingHeader.Algorithm, algo)
+		if _, err := tx.Exec("DELETE FROM checksums"); err != nil {
+			return Result{}, err
+		}
+		changed = true
+	}
+	if count > 0 && existingHeader.FollowSymlinks != s.FollowSymlinks {
+		changed = true
+	}
+
+	// The walk and the collector share the transaction's connection;
+	// mu keeps their statements from interleaving, and dbErr holds the
+	// first error either meets.
+	var mu sync.Mutex
+	var dbErr error
+	run := time.Now().UnixNano()
+	exec := func(query string, args ...any) {
+		mu.Lock()
+		defer mu.Unlock()
+		if _, err := tx.Exec(query, args...); err != nil && dbErr == nil {
+			dbErr = err
+		}
+	}
+	lookup := func(key string) (Record, bool) {
+		mu.Lock()
+		defer mu.Unlock()
+		rec, err := scanRecord(tx.QueryRow("SELECT hash, size, mtime, mode, hashed_at FROM checksums WHERE path = ?", key))
+		if err != nil && !errors.Is(err, sql.ErrNoRows) && dbErr == nil {
+			dbErr = err
+		}
+		return rec, err == nil
+	}
+
+	var added, modified, removed []string
+	var bytesHashed, bytesSkipped int64
+	var failed, walkFailed []FileError
+	var unstable, unreadable, sizeOnly, bySize, deferred, unreadableDirs []string
+	var empty int
+	var timings []FileTiming
+	processingStart := time.Now()
+
+	w := newWalker(s, roots, dbPath)
+	for _, suffix := range dbSidecars {
+		w.skip[dbPath+suffix] = true
+	}
+	pending := make(chan hashJob, s.queueSize())
+	results := hashWorkers(ctx, s.jobs(), s.readOptions(), newHash, pending)
+	collected := make(chan struct{})
+	go func() {
+		defer close(collected)
+		for res := range results {
+			s.countHashed(res.bytes)
+			bytesHashed += res.bytes
+			if s.Stats {
+				timings = append(timings, FileTiming{Path: res.relPath, Bytes: res.bytes, Duration: res.elapsed})
+			}
+			if res.err != nil {
+				s.errorf("Checksum failed: %s - %v", res.path, res.err)
+				failed = append(failed, FileError{Path: res.relPath, Err: res.err})
+				s.failFast(failed[len(failed)-1])
+				continue
+			}
+			if res.unstable {
+				s.errorf("WARNING: %s changed while being hashed, its checksum may be stale", res.relPath)
+				unstable = append(unstable, res.relPath)
+			}
+			if !res.metadata && res.info.Size() == 0 {
+				empty++
+			}
+			rec := Record{
+				Hash:     res.sum,
+				Size:     res.info.Size(),
+				ModTime:  res.info.ModTime(),
+				Mode:     permBits(res.info),
+				HashedAt: time.Now(),
+			}
+			existing, exists := lookup(res.relPath)
+			if exists && existing.Hash != rec.Hash && existing.Size == rec.Size && existing.ModTime.Equal(rec.ModTime) {
+				s.errorf("WARNING: %s changed content without changing size or modtime", res.relPath)
+			}
+			if exists && existing.equal(rec) {
+				continue
+			}
+			exec(`INSERT INTO checksums (path, hash, size, mtime, mode, hashed_at, seen) VALUES (?, ?, ?, ?, ?, ?, ?)
+				ON CONFLICT (path) DO UPDATE SET hash = excluded.hash, size = excluded.size, mtime = excluded.mtime,
+				mode = excluded.mode, hashed_at = excluded.hashed_at, seen = excluded.seen`,
+				res.relPath, rec.Hash, rec.Size, rec.ModTime.UnixNano(), rec.Mode, rec.HashedAt.UnixNano(), run)
+			changed = true
+			switch {
+			case !exists:
+				added = append(added, res.relPath)
+			case existing.Hash != rec.Hash:
+				modified = append(modified, res.relPath)
+			}
+		}
+	}()
+
+	var prefixErr error
+	for _, r := range roots {
+		visit := func(path, relPath string, info os.FileInfo) error {
+			if !r.hasPrefix(relPath) {
+				prefixErr = fmt.Errorf("%s does not start with the prefix %s to strip", r.key(relPath), r.strip)
+				return prefixErr
+			}
+			key := r.key(relPath)
+			s.tracef("Checking %s", key)
+			if !s.sizeAllowed(info) {
+				s.tracef("Skipping %s, %d bytes is outside the size limits", key, info.Size())
+				bySize = append(bySize, key)
+				return nil
+			}
+			exec("UPDATE checksums SET seen = ? WHERE path = ?", run, key)
+			if s.tooYoung(info) {
+				s.tracef("Deferring %s, modified %v ago", key, time.Since(info.ModTime()).Round(time.Millisecond))
+				deferred = append(deferred, key)
+				return nil
+			}
+			existing, exists := lookup(key)
+			if exists && sizeOnlyChange(existing, info) {
+				s.warnSizeOnly(key, existing, info)
+				sizeOnly = append(sizeOnly, key)
+			}
+			if !s.Force && !s.MetadataOnly && exists && !s.stale(existing, info, time.Time{}) && !s.due(existing) {
+				if s.Progress != nil {
+					s.Progress.Skipped.Add(1)
+				}
+				bytesSkipped += info.Size()
+				return nil
+			}
+			s.countQueued(info.Size())
+			select {
+			case pending <- hashJob{path: path, relPath: key, info: info, metadata: s.MetadataOnly}:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			return nil
+		}
+		markUnreadable := func(relPath string, err error) {
+			unreadable = append(unreadable, r.key(relPath))
+			var le *listError
+			switch {
+			case errors.As(err, &le):
+				s.errorf("WARNING: cannot list %s, nothing below it was scanned - %v", r.key(relPath), le.Err)
+				unreadableDirs = append(unreadableDirs, r.key(relPath))
+				walkFailed = append(walkFailed, FileError{Path: r.key(relPath), Err: err})
+				s.failFast(walkFailed[len(walkFailed)-1])
+			case err != nil:
+				s.errorf("Cannot read %s - %v", r.key(relPath), err)
+				walkFailed = append(walkFailed, FileError{Path: r.key(relPath), Err: err})
+				s.failFast(walkFailed[len(walkFailed)-1])
+			}
+		}
+		if s.Files != nil {
+			w.visitList(ctx, r.dir, s.Files, visit, markUnreadable)
+		} else {
+			w.walk(ctx, r.dir, visit, markUnreadable)
+		}
+	}
+	s.walked()
+	close(pending)
+	<-collected
+	failed = append(failed, walkFailed...)
+	if dbErr != nil {
+		return Result{}, dbErr
+	}
+	if prefixErr != nil {
+		return Result{}, prefixErr
+	}
+
+	interrupted := ctx.Err() != nil
+	if interrupted && s.stop == nil {
+		s.logf("Interrupted, saving partial results")
+	}
+	if !s.NoPrune && !interrupted && (s.Files == nil || s.pruneListed) {
+		var gone []string
+		if s.Files != nil {
+			gone = missingFiles(roots[0], s.Files)
+		}
+		rows, err := tx.Query("SELECT path FROM checksums WHERE seen != ?", run)
+		if err != nil {
+			return Result{}, err
+		}
+		for rows.Next() {
+			var key string
+			if err := rows.Scan(&key); err != nil {
+				rows.Close()
+				return Result{}, err
+			}
+			if underAny(key, unreadable) || (s.Files != nil && !underAny(key, gone)) {
+				continue
+			}
+			removed = append(removed, key)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return Result{}, err
+		}
+		for _, key := range removed {
+			if _, err := tx.Exec("DELETE FROM checksums WHERE path = ?", key); err != nil {
+				return Result{}, err
+			}
+			changed = true
+		}
+	}
+	if changed {
+		symlinks := ""
+		if s.FollowSymlinks {
+			symlinks = symlinksFollowed
+		}
+		for key, value := range map[string]string{headerAlgorithm: algo, headerSymlinks: symlinks} {
+			if _, err := tx.Exec("INSERT INTO meta (key, value) VALUES (?, ?) ON CONFLICT (key) DO UPDATE SET value = excluded.value", key, value); err != nil {
+				return Result{}, err
+			}
+		}
+	}
+	if err := tx.QueryRow("SELECT COUNT(*) FROM checksums").Scan(&count); err != nil {
+		return Result{}, err
+	}
+
+	sort.Strings(added)
+	sort.Strings(modified)
+	sort.Strings(removed)
+	sort.Strings(unstable)
+	sort.Strings(sizeOnly)
+	sort.Strings(bySize)
+	sort.Strings(deferred)
+	sort.Strings(unreadableDirs)
+	sort.Slice(failed, func(i, j int) bool { return failed[i].Path < failed[j].Path })
+	if !s.DryRun {
+		for _, key := range removed {
+			s.logf("Pruning %s", key)
+		}
+	}
+	res := Result{
+		Output:         dbPath,
+		Algorithm:      algo,
+		Entries:        count,
+		Changed:        changed,
+		Processed:      len(added) + len(modified),
+		BytesHashed:    bytesHashed,
+		BytesSkipped:   bytesSkipped,
+		Added:          added,
+		Modified:       modified,
+		Removed:        removed,
+		Unstable:       unstable,
+		SizeOnly:       sizeOnly,
+		SkippedBySize:  bySize,
+		Deferred:       deferred,
+		UnreadableDirs: unreadableDirs,
+		Empty:          empty,
+		Failed:         failed,
+		Duration:       time.Since(processingStart),
+		Stats:          newHashStats(timings),
+	}
+	if err := s.stoppedAt(ctx, dbPath); err != nil {
+		return res, err
+	}
+	if s.FailOnError && len(failed) > 0 && !interrupted {
+		return res, &FailedError{Output: dbPath, Failed: failed}
+	}
+	if s.DryRun {
+		s.logf("Dry run, %s left untouched", dbPath)
+		return res, ctx.Err()
+	}
+	if !changed {
+		s.logf("No changes detected. Existing database preserved: %s", dbPath)
+		return res, ctx.Err()
+	}
+	if err := tx.Commit(); err != nil {
+		return res, err
+	}
+	committed = true
+	res.Written = true
+	return res, ctx.Err()
+}
@@ -0,0 +1,30 @@
+package incmd5
+
+import "sort"
+
+// FindDuplicates groups the paths in checksums that share a digest. Only
+// groups of two or more are returned; paths within a group are sorted and
+// groups are ordered by their first path. Empty directories, which all
+// share a digest, are left out.
+func FindDuplicates(checksums map[string]Record) [][]string {
+	byHash := make(map[string][]string)
+	for path, rec := range checksums {
+		if isDirKey(path) {
+			continue
+		}
+		byHash[rec.Hash] = append(byHash[rec.Hash], path)
+	}
+
+	var groups [][]string
+	for _, paths := range byHash {
+		if len(paths) < 2 {
+			continue
+		}
+		sort.Strings(paths)
+		groups = append(groups, paths)
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		return groups[i][0] < groups[j][0]
+	})
+	return groups
+}
@@ -0,0 +1,33 @@
+package incmd5
+
+import (
+	"hash"
+	"io"
+	"os"
+	"strings"
+)
+
+// isDirKey reports whether key is the entry of an empty directory, which
+// unlike a file's ends in a slash.
+func isDirKey(key string) bool {
+	return strings.HasSuffix(key, "/")
+}
+
+// emptyDirSum returns the digest recorded for every empty directory: all
+// zeros, as long as a digest of newHash, so that every format reads it
+// back like any other.
+func emptyDirSum(newHash func() hash.Hash) string {
+	return strings.Repeat("0", 2*newHash().Size())
+}
+
+// isEmptyDir reports whether the directory at path has no entries. One
+// that cannot be read is not empty.
+func isEmptyDir(path string) bool {
+	dir, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer dir.Close()
+	_, err = dir.Readdirnames(1)
+	return err == io.EOF
+}
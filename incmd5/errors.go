@@ -0,0 +1,41 @@
+package incmd5
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Errors that callers can test for with errors.Is. A *CorruptError matches
+// ErrManifestCorrupt, and a *FailedError and every FileError also match
+// the error they wrap, such as fs.ErrPermission.
+var (
+	// ErrRootNotFound is wrapped by the error of a scan or verification of
+	// a directory that does not exist, and ErrNotDirectory by that of one
+	// given a path that is not a directory where one is required.
+	ErrRootNotFound = errors.New("directory does not exist")
+	ErrNotDirectory = errors.New("not a directory")
+	// ErrManifestCorrupt matches every *CorruptError.
+	ErrManifestCorrupt = errors.New("corrupt checksum file")
+)
+
+// FailedError is returned by a scan with FailOnError that could not read
+// some files, and so left the checksum file untouched. errors.As finds it
+// with a *FailedError variable as target, and each FileError of Failed
+// through it with a FileError one.
+type FailedError struct {
+	// Output is the checksum file or database left untouched.
+	Output string
+	Failed []FileError
+}
+
+func (e *FailedError) Error() string {
+	return fmt.Sprintf("%d files could not be read, %s left untouched", len(e.Failed), e.Output)
+}
+
+func (e *FailedError) Unwrap() []error {
+	errs := make([]error, len(e.Failed))
+	for i, fe := range e.Failed {
+		errs[i] = fe
+	}
+	return errs
+}
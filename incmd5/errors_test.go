@@ -0,0 +1,114 @@
+package incmd5
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeFiles creates the files of contents, by slash-separated path
+// below dir, and any directories they need.
+func writeFiles(t *testing.T, dir string, contents map[string]string) {
+	t.Helper()
+	for name, data := range contents {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// unreadableFile creates a file at path that cannot be opened, skipping
+// the test where permissions are not enforced, as for root.
+func unreadableFile(t *testing.T, path string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte("secret\n"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if f, err := os.Open(path); err == nil {
+		f.Close()
+		t.Skip("file permissions are not enforced for this user")
+	}
+}
+
+func TestErrRootNotFound(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "missing")
+	s := &Scanner{Output: filepath.Join(t.TempDir(), "md5sums.txt")}
+	if _, err := s.Scan(dir); !errors.Is(err, ErrRootNotFound) {
+		t.Errorf("Scan: got %v, want ErrRootNotFound", err)
+	}
+	if _, err := s.Verify(dir); !errors.Is(err, ErrRootNotFound) {
+		t.Errorf("Verify: got %v, want ErrRootNotFound", err)
+	}
+}
+
+func TestErrNotDirectory(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{"file.txt": "x"})
+	s := &Scanner{Output: filepath.Join(dir, "md5sums.txt")}
+	if _, err := s.Verify(filepath.Join(dir, "file.txt")); !errors.Is(err, ErrNotDirectory) {
+		t.Errorf("Verify: got %v, want ErrNotDirectory", err)
+	}
+	other := t.TempDir()
+	if _, err := s.ScanDirsContext(t.Context(), []string{other, filepath.Join(dir, "file.txt")}); !errors.Is(err, ErrNotDirectory) {
+		t.Errorf("ScanDirsContext: got %v, want ErrNotDirectory", err)
+	}
+}
+
+func TestErrManifestCorrupt(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"file.txt":    "x",
+		"md5sums.txt": "d41d8cd98f00b204e9800998ecf8427e  file.txt\nnot an entry\n",
+	})
+	output := filepath.Join(dir, "md5sums.txt")
+
+	_, _, err := ReadChecksums(output)
+	if !errors.Is(err, ErrManifestCorrupt) {
+		t.Errorf("ReadChecksums: got %v, want ErrManifestCorrupt", err)
+	}
+	var corrupt *CorruptError
+	if !errors.As(err, &corrupt) {
+		t.Fatalf("ReadChecksums: got %v, want a *CorruptError", err)
+	}
+	if corrupt.Path != output || corrupt.Skipped != 1 || corrupt.Line != 2 {
+		t.Errorf("got %+v, want 1 skipped line at line 2 of %s", corrupt, output)
+	}
+
+	s := &Scanner{Output: output}
+	if _, err := s.Scan(dir); !errors.Is(err, ErrManifestCorrupt) {
+		t.Errorf("Scan: got %v, want ErrManifestCorrupt", err)
+	}
+}
+
+func TestFailedError(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{"ok.txt": "x"})
+	unreadableFile(t, filepath.Join(dir, "secret.txt"))
+	output := filepath.Join(dir, "md5sums.txt")
+
+	s := &Scanner{Output: output, FailOnError: true}
+	_, err := s.Scan(dir)
+	var failed *FailedError
+	if !errors.As(err, &failed) {
+		t.Fatalf("got %v, want a *FailedError", err)
+	}
+	if failed.Output != output || len(failed.Failed) != 1 || failed.Failed[0].Path != "secret.txt" {
+		t.Errorf("got %+v, want secret.txt failing for %s", failed, output)
+	}
+	var fe FileError
+	if !errors.As(err, &fe) || fe.Path != "secret.txt" {
+		t.Errorf("errors.As found FileError %+v, want secret.txt", fe)
+	}
+	if !errors.Is(err, fs.ErrPermission) {
+		t.Errorf("got %v, want it to match fs.ErrPermission", err)
+	}
+	if _, err := os.Stat(output); !os.IsNotExist(err) {
+		t.Errorf("checksum file written despite the failure: %v", err)
+	}
+}
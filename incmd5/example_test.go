@@ -0,0 +1,62 @@
+package incmd5_test
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+
+	"incrementalmd5/incmd5"
+)
+
+func ExampleScanner_Scan() {
+	dir, err := os.MkdirTemp("", "incmd5-example")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := os.WriteFile(filepath.Join(dir, "hello.txt"), []byte("hello\n"), 0644); err != nil {
+		log.Fatal(err)
+	}
+
+	s := &incmd5.Scanner{Output: filepath.Join(dir, "md5sums.txt")}
+	res, err := s.Scan(dir)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println("added:", res.Added, "written:", res.Written)
+
+	// Nothing changed since, so the second run reads no file and leaves
+	// the checksum file alone.
+	res, err = s.Scan(dir)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println("added:", res.Added, "written:", res.Written)
+	// Output:
+	// added: [hello.txt] written: true
+	// added: [] written: false
+}
+
+func ExampleReadChecksums() {
+	dir, err := os.MkdirTemp("", "incmd5-example")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := os.WriteFile(filepath.Join(dir, "hello.txt"), []byte("hello\n"), 0644); err != nil {
+		log.Fatal(err)
+	}
+	output := filepath.Join(dir, "md5sums.txt")
+	if _, err := (&incmd5.Scanner{Output: output}).Scan(dir); err != nil {
+		log.Fatal(err)
+	}
+
+	checksums, header, err := incmd5.ReadChecksums(output)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println(header.Algorithm, checksums["hello.txt"].Hash)
+	// Output:
+	// md5 b1946ac92492d2347c6235b4d2611184
+}
@@ -0,0 +1,79 @@
+package incmd5
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// DefaultFetchTimeout bounds the download of a Reference URL when
+// Scanner.FetchTimeout is zero.
+const DefaultFetchTimeout = 30 * time.Second
+
+// IsURL reports whether ref is an http or https URL rather than a path.
+func IsURL(ref string) bool {
+	return strings.HasPrefix(ref, "http://") || strings.HasPrefix(ref, "https://")
+}
+
+// readReference loads the checksums to compare against from Reference,
+// fetching it if it is a URL.
+func (s *Scanner) readReference(ctx context.Context) (map[string]Record, Header, error) {
+	if !IsURL(s.Reference) {
+		return ReadChecksums(s.Reference)
+	}
+	timeout := s.FetchTimeout
+	if timeout == 0 {
+		timeout = DefaultFetchTimeout
+	}
+	return fetchChecksums(ctx, s.Reference, timeout)
+}
+
+// fetchChecksums downloads the checksum file at rawURL into a temporary
+// file named like the last element of the URL's path, so that ReadChecksums
+// judges its format and compression by the same extensions as a local
+// file, and reads it from there. Unlike a missing local file, a URL that
+// does not answer 200 OK is an error.
+func fetchChecksums(ctx context.Context, rawURL string, timeout time.Duration) (map[string]Record, Header, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, Header{}, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil, Header{}, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, Header{}, fmt.Errorf("cannot fetch %s: %w", u.Redacted(), err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, Header{}, fmt.Errorf("cannot fetch %s: %s", u.Redacted(), resp.Status)
+	}
+
+	name := path.Base(u.Path)
+	if name == "." || name == "/" {
+		name = "checksums"
+	}
+	tmp, err := os.CreateTemp("", "incmd5-*-"+name)
+	if err != nil {
+		return nil, Header{}, err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = io.Copy(tmp, resp.Body)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, Header{}, fmt.Errorf("cannot fetch %s: %w", u.Redacted(), err)
+	}
+	return ReadChecksums(tmp.Name())
+}
@@ -0,0 +1,33 @@
+package incmd5
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// gitChangedFiles returns the paths, relative to dir, of the files below
+// dir that git diff lists as changed in revs, such as main..HEAD. Renamed
+// files are listed under both names, so that the old one can be pruned.
+func gitChangedFiles(ctx context.Context, dir, revs string) ([]string, error) {
+	if revs == "" || strings.HasPrefix(revs, "-") {
+		return nil, fmt.Errorf("invalid git range %q", revs)
+	}
+	out, err := exec.CommandContext(ctx, "git", "-C", dir, "diff", "--name-only", "--no-renames", "--relative", "-z", revs, "--").Output()
+	if err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) && len(exitErr.Stderr) > 0 {
+			return nil, fmt.Errorf("git diff %s failed: %s", revs, strings.TrimSpace(string(exitErr.Stderr)))
+		}
+		return nil, fmt.Errorf("git diff %s failed: %w", revs, err)
+	}
+	files := []string{}
+	for _, name := range strings.Split(string(out), "\x00") {
+		if name != "" {
+			files = append(files, name)
+		}
+	}
+	return files, nil
+}
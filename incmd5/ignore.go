@@ -0,0 +1,121 @@
+package incmd5
+
+import (
+	"bufio"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// DefaultIgnoreFile is the name of the per-directory ignore file read by
+// the command line tool.
+const DefaultIgnoreFile = ".md5ignore"
+
+// ignoreRule is one pattern line of an ignore file.
+type ignoreRule struct {
+	// base is the slash-separated directory of the ignore file relative to
+	// the scan root, or "" for the root itself.
+	base    string
+	pattern string
+	// negate re-includes paths matched by an earlier rule.
+	negate bool
+	// dirOnly restricts the rule to directories.
+	dirOnly bool
+	// anchored rules match the path below base; others match the base
+	// name at any depth.
+	anchored bool
+}
+
+// readIgnoreFile parses the gitignore-style file at name, found in the
+// directory relDir below the scan root. A missing file yields no rules.
+func readIgnoreFile(name, relDir string) ([]ignoreRule, error) {
+	file, err := os.Open(name)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	base := filepath.ToSlash(relDir)
+	if base == "." {
+		base = ""
+	}
+	var rules []ignoreRule
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if rule, ok := parseIgnoreLine(scanner.Text(), base); ok {
+			rules = append(rules, rule)
+		}
+	}
+	return rules, scanner.Err()
+}
+
+// parseIgnoreLine parses one line of an ignore file using gitignore rules:
+// blank lines and lines starting with '#' are skipped, '!' negates, a
+// trailing '/' matches directories only, and a pattern containing a slash
+// other than a trailing one is anchored at the ignore file's directory.
+func parseIgnoreLine(line, base string) (ignoreRule, bool) {
+	line = strings.TrimSuffix(line, "\r")
+	if !strings.HasSuffix(line, `\ `) {
+		line = strings.TrimRight(line, " ")
+	}
+	if line == "" || line[0] == '#' {
+		return ignoreRule{}, false
+	}
+
+	rule := ignoreRule{base: base}
+	switch {
+	case line[0] == '!':
+		rule.negate = true
+		line = line[1:]
+	case strings.HasPrefix(line, `\!`), strings.HasPrefix(line, `\#`):
+		line = line[1:]
+	}
+	if strings.HasSuffix(line, "/") {
+		rule.dirOnly = true
+		line = strings.TrimSuffix(line, "/")
+	}
+	if strings.Contains(line, "/") {
+		rule.anchored = true
+		line = strings.TrimPrefix(line, "/")
+	}
+	if line == "" {
+		return ignoreRule{}, false
+	}
+	rule.pattern = line
+	return rule, true
+}
+
+// match reports whether the rule applies to the slash-separated relPath.
+func (r ignoreRule) match(relPath string, isDir bool) bool {
+	if r.dirOnly && !isDir {
+		return false
+	}
+	if r.base != "" {
+		if !strings.HasPrefix(relPath, r.base+"/") {
+			return false
+		}
+		relPath = relPath[len(r.base)+1:]
+	}
+	if !r.anchored {
+		relPath = path.Base(relPath)
+	}
+	return matchGlob(r.pattern, relPath)
+}
+
+// ignored reports whether relPath is ignored by rules. As with gitignore,
+// the last matching rule decides, and rules from deeper ignore files come
+// later than those of their parents.
+func ignored(rules []ignoreRule, relPath string, isDir bool) bool {
+	slashed := filepath.ToSlash(relPath)
+	ignore := false
+	for _, r := range rules {
+		if r.match(slashed, isDir) {
+			ignore = !r.negate
+		}
+	}
+	return ignore
+}
@@ -0,0 +1,466 @@
+// Package incmd5 maintains a checksum file for a directory tree, rehashing
+// only the files that changed since the previous run.
+//
+// A Scanner holds the options for a run; its zero value hashes with MD5
+// using one worker per CPU and needs only an Output path:
+//
+//	s := &incmd5.Scanner{Output: "md5sums.txt", Logger: log.Default()}
+//	res, err := s.Scan("photos")
+//	if err != nil {
+//		return err
+//	}
+//	fmt.Printf("%d files changed, %d entries\n", res.Processed, res.Entries)
+//
+// Verify checks the files of a tree against an existing checksum file
+// without modifying anything.
+package incmd5
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"io/fs"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/cespare/xxhash/v2"
+	"lukechampine.com/blake3"
+)
+
+// MD5TimestampFile is the default name of the marker file, kept inside the
+// scanned directory, whose modtime records when the last run finished.
+var MD5TimestampFile = ".md5sum-timestamp"
+
+// MD5LockFile is the name of the file, kept inside the scanned directory,
+// that a scan holds exclusively while it may write.
+var MD5LockFile = ".md5sum-lock"
+
+// Version identifies the tool in the headers written with
+// Scanner.WriteHeader. Release builds set it with
+// -ldflags "-X incrementalmd5/incmd5.Version=...".
+var Version = "dev"
+
+// DefaultRetryDelay is the wait before the first retry of a file that
+// failed with a transient error when Scanner.RetryDelay is zero.
+const DefaultRetryDelay = 100 * time.Millisecond
+
+// DefaultAlgorithm is used when a Scanner or checksum file names none.
+const DefaultAlgorithm = "md5"
+
+// DefaultBufferSize is the read buffer each worker uses when a Scanner sets
+// none. Reading in 1 MiB chunks rather than 8 KiB issues over a hundred
+// times fewer read calls on large files, at a memory cost that is small
+// next to one buffer per worker.
+const DefaultBufferSize = 1 << 20
+
+// MmapThreshold is the size from which a Scanner with Mmap set maps files
+// into memory instead of reading them. Below it, setting up the mapping
+// costs more than the copies it saves.
+const MmapThreshold = 64 << 20
+
+// MetadataAlgorithm is the algorithm recorded for checksum files written
+// with Scanner.MetadataOnly. Its digests are the MD5 of each file's key,
+// size and modtime rather than of its contents, so such a file cannot be
+// mistaken for, or checked as, one of content checksums.
+const MetadataAlgorithm = "metadata"
+
+// HashAlgorithms maps the supported algorithm names to their constructors.
+// xxhash64 and blake3 are much faster than MD5 for detecting changes;
+// xxhash64 is not cryptographic, and its 64-bit digests suit change
+// detection rather than guarding against tampering.
+var HashAlgorithms = map[string]func() hash.Hash{
+	"md5":      md5.New,
+	"sha1":     sha1.New,
+	"sha256":   sha256.New,
+	"sha512":   sha512.New,
+	"crc32":    func() hash.Hash { return crc32.NewIEEE() },
+	"xxhash64": func() hash.Hash { return xxhash.New() },
+	"blake3":   func() hash.Hash { return blake3.New(32, nil) },
+}
+
+// AlgorithmSeparator joins the names of several algorithms computed in a
+// single pass over each file, such as "md5,sha256". Their digests are
+// recorded in one entry, separated by a space in the order named; the
+// BSD and SFV formats, which name one algorithm per entry, cannot hold
+// them.
+const AlgorithmSeparator = ","
+
+// multiHash feeds what is written to it to every one of its hashes.
+type multiHash []hash.Hash
+
+func (m multiHash) Write(p []byte) (int, error) {
+	for _, h := range m {
+		h.Write(p)
+	}
+	return len(p), nil
+}
+
+func (m multiHash) Sum(b []byte) []byte {
+	for _, h := range m {
+		b = h.Sum(b)
+	}
+	return b
+}
+
+func (m multiHash) Reset() {
+	for _, h := range m {
+		h.Reset()
+	}
+}
+
+func (m multiHash) Size() int {
+	n := 0
+	for _, h := range m {
+		n += h.Size()
+	}
+	return n
+}
+
+func (m multiHash) BlockSize() int {
+	return m[0].BlockSize()
+}
+
+// digest returns the hex digest of h, or for a multiHash the digests of
+// its hashes separated by spaces.
+func digest(h hash.Hash) string {
+	m, ok := h.(multiHash)
+	if !ok {
+		return hex.EncodeToString(h.Sum(nil))
+	}
+	sums := make([]string, len(m))
+	for i, h := range m {
+		sums[i] = hex.EncodeToString(h.Sum(nil))
+	}
+	return strings.Join(sums, " ")
+}
+
+// FileHash returns the hex digest of the file at path computed with h,
+// using buf for reads.
+func FileHash(path string, buf []byte, h hash.Hash) (string, error) {
+	sum, _, err := fileHash(path, buf, h, nil, 0)
+	return sum, err
+}
+
+// fileHash is FileHash that also returns the number of bytes read. The
+// open and every read are made under limit. Files of at least mmapMin
+// bytes, if it is positive, are hashed through a memory mapping where the
+// platform supports it, falling back to reading them into buf.
+func fileHash(path string, buf []byte, h hash.Hash, limit ioLimiter, mmapMin int64) (string, int64, error) {
+	limit.acquire()
+	file, err := os.Open(path)
+	limit.release()
+	if err != nil {
+		return "", 0, err
+	}
+	defer file.Close()
+	if mmapMin > 0 {
+		if info, err := file.Stat(); err == nil && info.Mode().IsRegular() && info.Size() >= mmapMin {
+			if err := mmapHash(file, info.Size(), len(buf), h, limit); err == nil {
+				return digest(h), info.Size(), nil
+			}
+		}
+	}
+	return readerHash(limitedReader{file, limit}, buf, h)
+}
+
+// ioLimiter bounds the number of file operations in flight across
+// workers, so that hashing can stay parallel while disk access is not. A
+// nil ioLimiter imposes no limit.
+type ioLimiter chan struct{}
+
+// newIOLimiter returns a limiter admitting n operations at once, or nil
+// if n is not positive.
+func newIOLimiter(n int) ioLimiter {
+	if n <= 0 {
+		return nil
+	}
+	return make(ioLimiter, n)
+}
+
+func (l ioLimiter) acquire() {
+	if l != nil {
+		l <- struct{}{}
+	}
+}
+
+func (l ioLimiter) release() {
+	if l != nil {
+		<-l
+	}
+}
+
+// limitedReader makes each Read of r under limit, releasing it before the
+// data is hashed.
+type limitedReader struct {
+	r     io.Reader
+	limit ioLimiter
+}
+
+func (lr limitedReader) Read(p []byte) (int, error) {
+	lr.limit.acquire()
+	defer lr.limit.release()
+	return lr.r.Read(p)
+}
+
+// ReaderHash returns the hex digest of everything read from r computed
+// with h, using buf for reads.
+func ReaderHash(r io.Reader, buf []byte, h hash.Hash) (string, error) {
+	sum, _, err := readerHash(r, buf, h)
+	return sum, err
+}
+
+// readerHash is ReaderHash that also returns the number of bytes read.
+func readerHash(r io.Reader, buf []byte, h hash.Hash) (string, int64, error) {
+	n, err := io.CopyBuffer(h, r, buf)
+	if err != nil {
+		return "", n, err
+	}
+	return digest(h), n, nil
+}
+
+// Progress counts the work done by a running scan or verification. The
+// counters are updated atomically and may be read while it runs.
+type Progress struct {
+	// Hashed counts files hashed.
+	Hashed atomic.Int64
+	// Skipped counts files left alone because they were unchanged.
+	Skipped atomic.Int64
+	// Bytes counts bytes read while hashing.
+	Bytes atomic.Int64
+	// Queued counts the files sent to be hashed and QueuedBytes their
+	// sizes, where known. Walked is set once every file has been queued;
+	// until then the totals are still growing, and since the walk waits
+	// for the workers once their queue is full, they may trail far behind
+	// the size of the tree.
+	Queued      atomic.Int64
+	QueuedBytes atomic.Int64
+	Walked      atomic.Bool
+}
+
+type hashJob struct {
+	path    string
+	relPath string
+	info    os.FileInfo
+	// archive also hashes the members of the file, an archive.
+	archive bool
+	// metadata digests the key, size and modtime of the file instead of
+	// reading it.
+	metadata bool
+	// reuse, if set, is the entry the file was renamed from, whose digest
+	// is recorded without reading the file.
+	reuse *Record
+	// linked reports that the file has other hard links, which may take
+	// its digest.
+	linked bool
+	// chunks is the chunk index of the file's entry, from which its hash
+	// may resume if readOptions.chunkMin is positive.
+	chunks []Chunk
+}
+
+type hashResult struct {
+	hashJob
+	sum   string
+	bytes int64
+	err   error
+	// unstable reports that the file kept changing while it was hashed,
+	// so sum may not match any state it settled in.
+	unstable bool
+	// members holds the digests of an archive's members.
+	members []memberSum
+	// elapsed is the time the file took to hash, if readOptions.timed.
+	elapsed time.Duration
+	// chunks is the file's new chunk index, and resumed the bytes whose
+	// hashing it saved, if readOptions.chunkMin is positive.
+	chunks  []Chunk
+	resumed int64
+}
+
+// readOptions controls how workers read the files they hash.
+type readOptions struct {
+	// bufSize is the size of each worker's read buffer.
+	bufSize int
+	// limit bounds file access across workers.
+	limit ioLimiter
+	// mmapMin, if positive, is the size from which files are mapped
+	// rather than read.
+	mmapMin int64
+	// retries is how many times a file is read again after a transient
+	// error, waiting retryDelay before the first retry and twice as long
+	// before each further one.
+	retries    int
+	retryDelay time.Duration
+	// timed records how long each file takes in hashResult.elapsed.
+	timed bool
+	// emptyConstant gives files whose info says they are empty the digest
+	// of no input without opening them.
+	emptyConstant bool
+	// chunkMin, if positive, is the size from which files are hashed
+	// through a chunk index, with a resumable hash, instead of being read
+	// whole or mapped.
+	chunkMin int64
+}
+
+// hashStable hashes the file of job and, if job carries the file's info,
+// stats it again afterwards. A file whose size or modtime moved while it
+// was read is hashed once more against its new info, and reported as
+// unstable if it changes again. The members of a stable archive are
+// hashed afterwards.
+func hashStable(ctx context.Context, job hashJob, buf []byte, newHash func() hash.Hash, opts readOptions) hashResult {
+	if job.reuse != nil {
+		return hashResult{hashJob: job, sum: job.reuse.Hash}
+	}
+	if job.metadata {
+		return metadataHash(job, newHash())
+	}
+	if opts.emptyConstant && job.info != nil && job.info.Size() == 0 {
+		return hashResult{hashJob: job, sum: digest(newHash())}
+	}
+	res := hashRetrying(ctx, job, buf, newHash, opts)
+	if job.archive && res.err == nil && !res.unstable {
+		members, n, err := hashMembers(job.path, job.relPath, buf, newHash, opts.limit)
+		res.members = members
+		res.bytes += n
+		if err != nil {
+			res.err = fmt.Errorf("reading archive: %w", err)
+		}
+	}
+	return res
+}
+
+// hashRetrying is hashFile retried with backoff as long as it fails with
+// a transient error and opts allow, or until ctx is cancelled. The final
+// error notes how many attempts were made.
+func hashRetrying(ctx context.Context, job hashJob, buf []byte, newHash func() hash.Hash, opts readOptions) hashResult {
+	delay := opts.retryDelay
+	var bytes int64
+	for attempt := 1; ; attempt++ {
+		res := hashFile(job, buf, newHash, opts)
+		bytes += res.bytes
+		res.bytes = bytes
+		if res.err == nil || !retryable(res.err) {
+			return res
+		}
+		if attempt > opts.retries {
+			if attempt > 1 {
+				res.err = fmt.Errorf("%w (gave up after %d attempts)", res.err, attempt)
+			}
+			return res
+		}
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return res
+		}
+		delay *= 2
+	}
+}
+
+// retryable reports whether err may go away if the file is read again,
+// as with a stale NFS handle or an I/O timeout. Missing files, denied
+// access and directories are permanent.
+func retryable(err error) bool {
+	return !errors.Is(err, fs.ErrNotExist) && !errors.Is(err, fs.ErrPermission) &&
+		!errors.Is(err, syscall.EISDIR) && !errors.Is(err, fs.ErrInvalid)
+}
+
+// metadataHash digests the key, size and modtime of the file of job with
+// h, statting it if job carries no info.
+func metadataHash(job hashJob, h hash.Hash) hashResult {
+	res := hashResult{hashJob: job}
+	if res.info == nil {
+		res.info, res.err = os.Stat(job.path)
+		if res.err != nil {
+			return res
+		}
+	}
+	fmt.Fprintf(h, "%s\x00%d\x00%d", job.relPath, res.info.Size(), res.info.ModTime().UnixNano())
+	res.sum = digest(h)
+	return res
+}
+
+// testHookHashed, if set, is called by hashFile with the path of each
+// file it has read, before statting it again, so that tests can change the
+// file as if it were written to while hashed.
+var testHookHashed func(path string)
+
+// hashFile is hashStable without the archive members.
+func hashFile(job hashJob, buf []byte, newHash func() hash.Hash, opts readOptions) hashResult {
+	var res hashResult
+	for attempt := 0; attempt < 2; attempt++ {
+		var c chunkedSum
+		var err error
+		if opts.chunkMin > 0 && job.info != nil && job.info.Size() >= opts.chunkMin {
+			c, err = chunkedHash(job.path, buf, newHash(), job.chunks, opts.limit)
+		} else {
+			c.sum, c.read, err = fileHash(job.path, buf, newHash(), opts.limit, opts.mmapMin)
+			c.length = c.read
+		}
+		if testHookHashed != nil {
+			testHookHashed(job.path)
+		}
+		res = hashResult{hashJob: job, sum: c.sum, bytes: res.bytes + c.read, err: err, chunks: c.chunks, resumed: c.resumed}
+		if err != nil || job.info == nil {
+			return res
+		}
+		after, err := os.Stat(job.path)
+		if err != nil || (after.Size() == job.info.Size() && after.ModTime().Equal(job.info.ModTime())) {
+			// A file that reads shorter than its unchanged size, such as
+			// one on a failing mount that reads as empty, must not get the
+			// digest of the bytes that happened to arrive.
+			if err == nil && c.length < after.Size() {
+				res.sum, res.err = "", fmt.Errorf("short read: got %d of %d bytes: %w", c.length, after.Size(), io.ErrUnexpectedEOF)
+			}
+			return res
+		}
+		job.info = after
+	}
+	res.unstable = true
+	return res
+}
+
+// hashWorkers starts n goroutines hashing the files received on jobs, each
+// reading through its own buffer of opts.bufSize bytes, with file access
+// bounded by opts.limit and retried as opts allow. The returned channel is
+// closed once jobs is closed and every file is done. Once ctx is
+// cancelled, files still queued are dropped without hashing.
+func hashWorkers(ctx context.Context, n int, opts readOptions, newHash func() hash.Hash, jobs <-chan hashJob) <-chan hashResult {
+	results := make(chan hashResult)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			buf := make([]byte, opts.bufSize)
+			for job := range jobs {
+				if ctx.Err() != nil {
+					continue
+				}
+				if !opts.timed {
+					results <- hashStable(ctx, job, buf, newHash, opts)
+					continue
+				}
+				start := time.Now()
+				res := hashStable(ctx, job, buf, newHash, opts)
+				res.elapsed = time.Since(start)
+				results <- res
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+	return results
+}
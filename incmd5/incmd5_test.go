@@ -0,0 +1,128 @@
+package incmd5
+
+import (
+	"crypto/md5"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestEmptyFileDigest(t *testing.T) {
+	const emptyMD5 = "d41d8cd98f00b204e9800998ecf8427e"
+	for _, constant := range []bool{false, true} {
+		dir := t.TempDir()
+		writeFiles(t, dir, map[string]string{"empty.txt": "", "full.txt": "x"})
+		s := &Scanner{Output: filepath.Join(dir, "md5sums.txt"), HashEmptyAsConstant: constant}
+		res, err := s.Scan(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := res.Checksums["empty.txt"].Hash; got != emptyMD5 {
+			t.Errorf("constant=%v: empty file recorded as %q, want %s", constant, got, emptyMD5)
+		}
+		if res.Empty != 1 {
+			t.Errorf("constant=%v: Result.Empty = %d, want 1", constant, res.Empty)
+		}
+	}
+}
+
+// appendTo appends data to the file at path.
+func appendTo(t *testing.T, path, data string) {
+	t.Helper()
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer f.Close()
+	if _, err := f.WriteString(data); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestFileChangedWhileHashed(t *testing.T) {
+	defer func() { testHookHashed = nil }()
+	tests := []struct {
+		name string
+		// writes is how many reads of the file are followed by a write.
+		writes   int
+		unstable bool
+	}{
+		{"settles", 1, false},
+		{"keeps changing", 2, true},
+	}
+	for _, tt := range tests {
+		dir := t.TempDir()
+		writeFiles(t, dir, map[string]string{"growing.log": "a"})
+		path := filepath.Join(dir, "growing.log")
+		var mu sync.Mutex
+		reads := 0
+		testHookHashed = func(hashed string) {
+			mu.Lock()
+			defer mu.Unlock()
+			if hashed == path && reads < tt.writes {
+				reads++
+				appendTo(t, path, "b")
+			}
+		}
+		s := &Scanner{Output: filepath.Join(dir, "md5sums.txt")}
+		res, err := s.Scan(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := slices.Contains(res.Unstable, "growing.log"); got != tt.unstable {
+			t.Errorf("%s: unstable = %v, want %v", tt.name, got, tt.unstable)
+		}
+		if tt.unstable {
+			continue
+		}
+		want, err := FileHash(path, make([]byte, 64), md5.New())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := res.Checksums["growing.log"].Hash; got != want {
+			t.Errorf("%s: recorded %s, want the settled file's %s", tt.name, got, want)
+		}
+	}
+}
+
+func TestQueueBackpressure(t *testing.T) {
+	defer func() { testHookHashed = nil }()
+	dir := t.TempDir()
+	files := make(map[string]string)
+	for i := 0; i < 200; i++ {
+		files[fmt.Sprintf("file%03d.txt", i)] = "x"
+	}
+	writeFiles(t, dir, files)
+
+	const jobs, queueSize = 2, 4
+	progress := new(Progress)
+	var mu sync.Mutex
+	var read, ahead int64
+	// Each file takes a while to hash, so the walk outruns the workers
+	// and must wait for them.
+	testHookHashed = func(string) {
+		time.Sleep(time.Millisecond)
+		mu.Lock()
+		defer mu.Unlock()
+		read++
+		ahead = max(ahead, progress.Queued.Load()-read)
+	}
+	s := &Scanner{Output: filepath.Join(dir, "md5sums.txt"), Jobs: jobs, QueueSize: queueSize, Progress: progress}
+	res, err := s.Scan(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Checksums) != len(files) {
+		t.Fatalf("recorded %d files, want %d", len(res.Checksums), len(files))
+	}
+	// Besides the queue, each worker holds a file and the walk one it is
+	// waiting to queue.
+	if limit := int64(queueSize + jobs + 1); ahead > limit {
+		t.Errorf("the walk ran %d files ahead of the workers, want at most %d", ahead, limit)
+	}
+}
@@ -0,0 +1,17 @@
+//go:build !unix
+
+package incmd5
+
+import "os"
+
+// fileID reports false where inode numbers are not available, so that
+// no file is matched by inode.
+func fileID(info os.FileInfo) (linkID, bool) {
+	return linkID{}, false
+}
+
+// fileLink reports false where hard links cannot be told apart, so that
+// every link is hashed.
+func fileLink(info os.FileInfo) (linkID, bool) {
+	return linkID{}, false
+}
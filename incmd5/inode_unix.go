@@ -0,0 +1,28 @@
+//go:build unix
+
+package incmd5
+
+import (
+	"os"
+	"syscall"
+)
+
+// fileID returns the device and inode of the file described by info, and
+// false if they are not known.
+func fileID(info os.FileInfo) (linkID, bool) {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return linkID{}, false
+	}
+	return linkID{dev: uint64(st.Dev), ino: uint64(st.Ino)}, true
+}
+
+// fileLink returns the device and inode of the file described by info if
+// it has more than one hard link, and false otherwise.
+func fileLink(info os.FileInfo) (linkID, bool) {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok || st.Nlink < 2 {
+		return linkID{}, false
+	}
+	return linkID{dev: uint64(st.Dev), ino: uint64(st.Ino)}, true
+}
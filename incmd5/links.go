@@ -0,0 +1,15 @@
+package incmd5
+
+// HardLink is a file that shares its content with another file of the
+// scan through a hard link, and so takes that file's digest without being
+// read.
+type HardLink struct {
+	Path   string `json:"path"`
+	LinkOf string `json:"link_of"`
+}
+
+// linkID identifies a file by its device and inode, which all of its hard
+// links share. Inode numbers are only unique within a device.
+type linkID struct {
+	dev, ino uint64
+}
@@ -0,0 +1,81 @@
+package incmd5
+
+import (
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// matchesAny reports whether relPath matches any of the glob patterns.
+// Paths are compared with forward slashes on every platform. A pattern
+// without a slash matches the base name at any depth, so "node_modules"
+// or "*.o" apply throughout the tree; a pattern with a slash is anchored
+// at the scan root and may use "**" to match any number of directories.
+// Exclude patterns are checked before anything else, so a path matching
+// an exclude is skipped even if it matches an include.
+func matchesAny(relPath string, patterns []string) bool {
+	slashed := filepath.ToSlash(relPath)
+	for _, pattern := range patterns {
+		name := slashed
+		if !strings.Contains(pattern, "/") {
+			name = path.Base(slashed)
+		}
+		if matchGlob(pattern, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// hasExtension reports whether relPath ends in one of exts, each given
+// with or without its leading dot, ignoring case.
+func hasExtension(relPath string, exts []string) bool {
+	ext := strings.TrimPrefix(filepath.Ext(relPath), ".")
+	if ext == "" {
+		return false
+	}
+	for _, want := range exts {
+		if strings.EqualFold(ext, strings.TrimPrefix(want, ".")) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchGlob matches a slash-separated name against pattern element by
+// element, with "**" standing for zero or more elements.
+func matchGlob(pattern, name string) bool {
+	return matchElements(strings.Split(pattern, "/"), strings.Split(name, "/"))
+}
+
+func matchElements(pattern, name []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(name); i++ {
+				if matchElements(pattern[1:], name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(name) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pattern[0], name[0]); !ok {
+			return false
+		}
+		pattern, name = pattern[1:], name[1:]
+	}
+	return len(name) == 0
+}
+
+// underAny reports whether the checksum key path equals or lies below any
+// of the given slash-separated relative paths.
+func underAny(path string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if prefix == "." || path == prefix || strings.HasPrefix(path, prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
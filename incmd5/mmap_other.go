@@ -0,0 +1,14 @@
+//go:build !(darwin || dragonfly || freebsd || linux || netbsd || openbsd)
+
+package incmd5
+
+import (
+	"errors"
+	"hash"
+	"os"
+)
+
+// mmapHash is not supported on this platform, so files are always read.
+func mmapHash(file *os.File, size int64, chunk int, h hash.Hash, limit ioLimiter) error {
+	return errors.ErrUnsupported
+}
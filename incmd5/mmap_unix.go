@@ -0,0 +1,32 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+
+package incmd5
+
+import (
+	"hash"
+	"os"
+	"syscall"
+)
+
+// mmapHash writes the size bytes of file to h through a read-only memory
+// mapping, chunk bytes at a time so that limit is held while the pages of
+// each chunk are faulted in. It fails without writing anything if the
+// file cannot be mapped; the mapping is always released.
+func mmapHash(file *os.File, size int64, chunk int, h hash.Hash, limit ioLimiter) error {
+	if int64(int(size)) != size {
+		return syscall.EFBIG
+	}
+	data, err := syscall.Mmap(int(file.Fd()), 0, int(size), syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		return err
+	}
+	defer syscall.Munmap(data)
+	for len(data) > 0 {
+		n := min(chunk, len(data))
+		limit.acquire()
+		h.Write(data[:n])
+		limit.release()
+		data = data[n:]
+	}
+	return nil
+}
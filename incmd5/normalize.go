@@ -0,0 +1,92 @@
+package incmd5
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Normalize rewrites the checksum file at Output in canonical form without
+// hashing anything: entries sorted by path, digests in lowercase, one
+// entry per path with the last occurrence winning, and the header and
+// layout the tool itself writes. The file keeps its format unless Format
+// is set. It reports whether the file changed, and with DryRun only
+// whether it would. A corrupt file is refused unless AllowCorrupt is set.
+func (s *Scanner) Normalize() (bool, error) {
+	if s.Output == "" {
+		return false, errors.New("no output path")
+	}
+	outputPath, err := filepath.Abs(s.Output)
+	if err != nil {
+		return false, err
+	}
+	if _, err := os.Stat(outputPath); err != nil {
+		return false, err
+	}
+	checksums, header, err := ReadChecksums(outputPath)
+	if err != nil {
+		if !s.AllowCorrupt {
+			return false, err
+		}
+		s.errorf("WARNING: %v; keeping the %d entries that could be read", err, len(checksums))
+	}
+	format := s.Format
+	if format == "" {
+		format = DetectFormat(outputPath)
+	}
+
+	if dups := len(readOrder(outputPath)) - len(checksums); dups > 0 && format != FormatJSON {
+		s.logf("Dropping %d duplicate entries", dups)
+	}
+	for key, rec := range checksums {
+		rec.Hash = strings.ToLower(rec.Hash)
+		checksums[key] = rec
+	}
+
+	var before, after bytes.Buffer
+	r, closeFile, err := openChecksums(outputPath)
+	if err != nil {
+		return false, err
+	}
+	_, err = io.Copy(&before, r)
+	closeFile()
+	if err != nil {
+		return false, err
+	}
+	if err := encodeChecksums(&after, checksums, sortedPaths(checksums), header, format); err != nil {
+		return false, err
+	}
+	if bytes.Equal(withoutStamp(before.Bytes()), withoutStamp(after.Bytes())) {
+		s.logf("%s is already normalized", outputPath)
+		return false, nil
+	}
+	if s.DryRun {
+		s.logf("Would normalize %s", outputPath)
+		return true, nil
+	}
+	if err := writeChecksums(outputPath, checksums, header, format, nil); err != nil {
+		return false, err
+	}
+	if s.SignKey != nil {
+		if err := SignFile(outputPath, s.SignKey); err != nil {
+			return false, fmt.Errorf("failed to sign %s: %w", outputPath, err)
+		}
+	}
+	s.logf("Normalized %s", outputPath)
+	return true, nil
+}
+
+// withoutStamp returns data without the leading "Generated by" comment of
+// an SFV file, which carries the time it was written.
+func withoutStamp(data []byte) []byte {
+	if bytes.HasPrefix(data, []byte(sfvHeaderPrefix+"Generated by ")) {
+		if i := bytes.IndexByte(data, '\n'); i >= 0 {
+			return data[i+1:]
+		}
+	}
+	return data
+}
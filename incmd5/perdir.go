@@ -0,0 +1,132 @@
+package incmd5
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+// perDirFiles maps the slash-separated directory of each checksum file
+// found in PerDir mode, "." for the root, to the header it was written
+// with.
+type perDirFiles map[string]Header
+
+// readPerDir loads every checksum file called name below r, visiting the
+// directories a scan would, and returns their entries keyed relative to r
+// together with where they were found. Files written with another
+// algorithm than algo contribute no entries, so that theirs are rehashed;
+// if algo is empty, the first file's algorithm is used and any other is an
+// error. The header returned is that of the file in r itself, if any.
+func (s *Scanner) readPerDir(ctx context.Context, r root, name, algo string) (map[string]Record, Header, perDirFiles, error) {
+	finder := *s
+	finder.Includes, finder.Extensions = nil, nil
+	if finder.LogLevel == LogVerbose {
+		// The scan itself traces every file.
+		finder.LogLevel = LogNormal
+	}
+	w := newWalker(&finder, []root{r}, "")
+
+	adopt := algo == ""
+	checksums := make(map[string]Record)
+	files := make(perDirFiles)
+	var top Header
+	err := w.walk(ctx, r.dir, func(filePath, relPath string, info os.FileInfo) error {
+		if filepath.Base(relPath) != name {
+			return nil
+		}
+		entries, header, err := ReadChecksums(filePath)
+		if err != nil {
+			if !s.AllowCorrupt {
+				return err
+			}
+			s.errorf("WARNING: %v; continuing with the %d entries that could be read", err, len(entries))
+		}
+		dir := path.Dir(r.key(relPath))
+		files[dir] = header
+		if dir == "." {
+			top = header
+		}
+		if algo == "" {
+			algo = header.Algorithm
+		}
+		if header.Algorithm != algo {
+			if adopt {
+				return fmt.Errorf("%s was written with %s, other checksum files with %s", filePath, header.Algorithm, algo)
+			}
+			s.logf("WARNING: %s was written with %s, recomputing its entries with %s", filePath, header.Algorithm, algo)
+			return nil
+		}
+		for key, rec := range entries {
+			checksums[perDirKey(dir, key)] = rec
+		}
+		return nil
+	}, func(string, error) {})
+	if algo == "" {
+		algo = DefaultAlgorithm
+	}
+	top.Algorithm = algo
+	return checksums, top, files, err
+}
+
+// perDirKey returns the key relative to the scan root of key, an entry of
+// the checksum file in the slash-separated directory dir.
+func perDirKey(dir, key string) string {
+	if dir == "." {
+		return key
+	}
+	return dir + "/" + key
+}
+
+// splitByDir groups checksums by the directory of their key, rekeying each
+// entry relative to that directory.
+func splitByDir(checksums map[string]Record) map[string]map[string]Record {
+	dirs := make(map[string]map[string]Record)
+	for key, rec := range checksums {
+		dir, base := path.Split(key)
+		dir = path.Clean(dir)
+		if dirs[dir] == nil {
+			dirs[dir] = make(map[string]Record)
+		}
+		dirs[dir][base] = rec
+	}
+	return dirs
+}
+
+// writePerDir writes the checksum file called name in every directory of
+// r whose entries, header or format differ from the files it had, and
+// removes the files of directories left without entries. It returns the
+// number of files written or removed.
+func (s *Scanner) writePerDir(r root, name string, existing, checksums map[string]Record, files perDirFiles, header Header, format string) (int, error) {
+	before, after := splitByDir(existing), splitByDir(checksums)
+	n := 0
+	for dir, entries := range after {
+		file := filepath.Join(r.dir, filepath.FromSlash(dir), name)
+		old, had := files[dir]
+		if had && mapsEqual(before[dir], entries) && old.Algorithm == header.Algorithm && old.FollowSymlinks == header.FollowSymlinks && old.NulTerminated == header.NulTerminated && old.CRLF == header.CRLF && old.Binary == header.Binary &&
+			(old.Generator != "") == (header.Generator != "") && DetectFormat(file) == format {
+			continue
+		}
+		var order []string
+		if s.StableOrder {
+			order = readOrder(file)
+		}
+		if err := writeChecksums(file, entries, header, format, order); err != nil {
+			return n, err
+		}
+		n++
+	}
+	for dir := range files {
+		if _, kept := after[dir]; kept {
+			continue
+		}
+		file := filepath.Join(r.dir, filepath.FromSlash(dir), name)
+		s.logf("Removing %s, which has no entries left", file)
+		if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
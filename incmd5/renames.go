@@ -0,0 +1,45 @@
+package incmd5
+
+// Rename is a file found under a new key with its old content.
+type Rename struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// detectRenames pairs each added key with a removed key of the same digest
+// and size, both taken in sorted order, and returns the pairs along with
+// the added and removed keys left unpaired.
+func detectRenames(added, removed []string, before, after map[string]Record) ([]Rename, []string, []string) {
+	type content struct {
+		hash string
+		size int64
+	}
+	candidates := make(map[content][]string)
+	for _, key := range removed {
+		rec := before[key]
+		c := content{rec.Hash, rec.Size}
+		candidates[c] = append(candidates[c], key)
+	}
+
+	var renamed []Rename
+	paired := make(map[string]bool)
+	var remaining []string
+	for _, key := range added {
+		rec := after[key]
+		c := content{rec.Hash, rec.Size}
+		if from := candidates[c]; len(from) > 0 {
+			renamed = append(renamed, Rename{From: from[0], To: key})
+			paired[from[0]] = true
+			candidates[c] = from[1:]
+			continue
+		}
+		remaining = append(remaining, key)
+	}
+	var unpaired []string
+	for _, key := range removed {
+		if !paired[key] {
+			unpaired = append(unpaired, key)
+		}
+	}
+	return renamed, remaining, unpaired
+}
@@ -0,0 +1,160 @@
+package incmd5
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// root is one directory of a scan. When several directories share a
+// checksum file, every key is prefixed with the root's label so entries
+// from different roots cannot collide; a lone root has no label and keeps
+// plain relative keys.
+type root struct {
+	// dir is the absolute path of the directory.
+	dir string
+	// label is the directory as given by the caller, cleaned and with
+	// forward slashes, or "" for a single root.
+	label string
+	// strip and add are the slash-separated prefixes removed from and
+	// then prepended to every key, or "" for none.
+	strip, add string
+	// timestamp and lock are the absolute paths of the root's timestamp
+	// and lock files.
+	timestamp string
+	lock      string
+}
+
+// key returns the checksum key for the OS-native relPath below r. Keys
+// always use forward slashes so that checksum files are portable. A key
+// without the prefix to strip keeps it; see hasPrefix.
+func (r root) key(relPath string) string {
+	key := filepath.ToSlash(relPath)
+	if r.label != "" {
+		key = path.Join(r.label, key)
+	}
+	if rest, ok := cutDir(key, r.strip); ok {
+		key = rest
+	}
+	if r.add != "" {
+		key = path.Join(r.add, key)
+	}
+	return key
+}
+
+// hasPrefix reports whether the key of relPath starts with the prefix r
+// strips, if any.
+func (r root) hasPrefix(relPath string) bool {
+	key := filepath.ToSlash(relPath)
+	if r.label != "" {
+		key = path.Join(r.label, key)
+	}
+	_, ok := cutDir(key, r.strip)
+	return ok
+}
+
+// cutDir returns key without the leading directory dir, reporting whether
+// key lies below it. An empty dir always matches.
+func cutDir(key, dir string) (string, bool) {
+	if dir == "" {
+		return key, true
+	}
+	return strings.CutPrefix(key, dir+"/")
+}
+
+// cleanPrefix validates a key prefix given by the user and returns it in
+// clean slash-separated form.
+func cleanPrefix(prefix string) (string, error) {
+	if prefix == "" {
+		return "", nil
+	}
+	clean := path.Clean(filepath.ToSlash(prefix))
+	if clean == "." || !filepath.IsLocal(filepath.FromSlash(clean)) {
+		return "", fmt.Errorf("invalid key prefix %q: want a relative path without ..", prefix)
+	}
+	return clean, nil
+}
+
+// homeLabel returns the label that keys the files of dir by their path
+// from home, as ~/path, reporting false if dir is not below home.
+func homeLabel(home, dir string) (string, bool) {
+	rel, err := filepath.Rel(home, dir)
+	if err != nil || !filepath.IsLocal(rel) {
+		return "", false
+	}
+	return path.Join("~", filepath.ToSlash(rel)), true
+}
+
+// resolveRoots returns the roots for dirs, checking that each exists and
+// that no two share a label or lie inside one another. Roots are absolute, which lets the os package
+// open paths below them that are longer than MAX_PATH on Windows, UNC
+// shares included, by adding the extended-length prefix itself.
+func resolveRoots(dirs []string) ([]root, error) {
+	if len(dirs) == 0 {
+		return nil, errors.New("no directory to scan")
+	}
+	roots := make([]root, 0, len(dirs))
+	labels := make(map[string]bool)
+	for _, dir := range dirs {
+		abs, err := filepath.Abs(dir)
+		if err != nil {
+			return nil, fmt.Errorf("invalid directory: %w", err)
+		}
+		info, err := os.Stat(abs)
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("%w: %s", ErrRootNotFound, abs)
+		}
+		if err == nil && !info.IsDir() {
+			return nil, fmt.Errorf("%w: %s", ErrNotDirectory, abs)
+		}
+		r := root{dir: abs, lock: filepath.Join(abs, MD5LockFile)}
+		if len(dirs) > 1 {
+			r.label = filepath.ToSlash(filepath.Clean(dir))
+			if labels[r.label] {
+				return nil, fmt.Errorf("directory given twice: %s", dir)
+			}
+			labels[r.label] = true
+		}
+		for i, other := range roots {
+			if nested(abs, other.dir) || nested(other.dir, abs) {
+				return nil, fmt.Errorf("directories overlap: %s and %s", dirs[i], dir)
+			}
+		}
+		roots = append(roots, r)
+	}
+	return roots, nil
+}
+
+// nested reports whether dir is ancestor or lies below it, as written or
+// once symlinks are resolved. Files in both would be recorded twice.
+func nested(ancestor, dir string) bool {
+	return within(ancestor, dir) || within(realPath(ancestor), realPath(dir))
+}
+
+// locate maps a checksum key back to the root it belongs to and the
+// slash-separated path relative to that root, undoing the prefixes the
+// roots add and strip. When labels nest, the longest match wins.
+func locate(roots []root, key string) (root, string, bool) {
+	key, ok := cutDir(key, roots[0].add)
+	if !ok {
+		return root{}, "", false
+	}
+	if roots[0].strip != "" {
+		key = path.Join(roots[0].strip, key)
+	}
+	var best root
+	bestRel, found := "", false
+	for _, r := range roots {
+		if r.label == "" {
+			return r, key, true
+		}
+		rel, ok := strings.CutPrefix(key, r.label+"/")
+		if ok && (!found || len(r.label) > len(best.label)) {
+			best, bestRel, found = r, rel, true
+		}
+	}
+	return best, bestRel, found
+}
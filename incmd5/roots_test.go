@@ -0,0 +1,38 @@
+package incmd5
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestNestedRoots(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{"a.txt": "a", "sub/b.txt": "b", "other/c.txt": "c"})
+	sub := filepath.Join(dir, "sub")
+	overlapping := [][]string{{dir, sub}, {sub, dir}}
+	// A symlink reaches the same files by another path.
+	link := filepath.Join(t.TempDir(), "link")
+	if err := os.Symlink(sub, link); err == nil {
+		overlapping = append(overlapping, []string{dir, link})
+	}
+	s := &Scanner{Output: filepath.Join(t.TempDir(), "md5sums.txt")}
+	for _, dirs := range overlapping {
+		_, err := s.ScanDirsContext(context.Background(), dirs)
+		if err == nil || !strings.Contains(err.Error(), "overlap") {
+			t.Errorf("%q: got %v, want an overlap error", dirs, err)
+		}
+	}
+
+	res, err := s.ScanDirsContext(context.Background(), []string{sub, filepath.Join(dir, "other")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{filepath.ToSlash(filepath.Join(dir, "other", "c.txt")), filepath.ToSlash(filepath.Join(sub, "b.txt"))}
+	if got := keys(res.Checksums); !slices.Equal(got, want) {
+		t.Errorf("recorded %q, want %q", got, want)
+	}
+}
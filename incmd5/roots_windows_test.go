@@ -0,0 +1,59 @@
+//go:build windows
+
+package incmd5
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// scanAndVerify scans root into a fresh checksum file and verifies it,
+// failing the test unless both see the files of contents.
+func scanAndVerify(t *testing.T, root string, contents map[string]string) {
+	t.Helper()
+	s := &Scanner{Output: filepath.Join(t.TempDir(), "md5sums.txt")}
+	res, err := s.Scan(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name := range contents {
+		if _, ok := res.Checksums[name]; !ok {
+			t.Errorf("%s not recorded, got %q", name, keys(res.Checksums))
+		}
+	}
+	vres, err := s.Verify(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if vres.Entries != len(res.Checksums) || len(vres.Mismatched)+len(vres.Missing)+len(vres.Failed) > 0 {
+		t.Errorf("verified %+v", vres)
+	}
+}
+
+func TestLongPathRoot(t *testing.T) {
+	root := t.TempDir()
+	for len(root) <= 260 {
+		root = filepath.Join(root, strings.Repeat("d", 50))
+	}
+	contents := map[string]string{"file.txt": "x", "sub/other.txt": "y"}
+	writeFiles(t, root, contents)
+	scanAndVerify(t, root, contents)
+}
+
+func TestUNCRoot(t *testing.T) {
+	dir := t.TempDir()
+	vol := filepath.VolumeName(dir)
+	if len(vol) != 2 || vol[1] != ':' {
+		t.Skipf("%s is not on a drive letter", dir)
+	}
+	// The administrative share of the drive reaches dir as a UNC path.
+	root := `\\localhost\` + vol[:1] + `$` + dir[len(vol):]
+	if _, err := os.Stat(root); err != nil {
+		t.Skipf("no administrative share: %v", err)
+	}
+	contents := map[string]string{"file.txt": "x", "sub/other.txt": "y"}
+	writeFiles(t, dir, contents)
+	scanAndVerify(t, root, contents)
+}
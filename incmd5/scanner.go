@@ -0,0 +1,1651 @@
+package incmd5
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/md5"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Scanner holds the options for scanning a tree into a checksum file.
+type Scanner struct {
+	// Output is the checksum file to read and update. It is gzipped if
+	// its name ends in .gz.
+	Output string
+	// Algorithm names an entry of HashAlgorithms; empty means MD5, or
+	// CRC32 for the SFV format.
+	Algorithm string
+	// Format is FormatText, FormatJSON, FormatBSD or FormatSFV; empty
+	// picks JSON or SFV for outputs ending in .json or .sfv, optionally
+	// followed by .gz, and text otherwise.
+	Format string
+	// Jobs is the number of files hashed concurrently; zero means one per
+	// CPU.
+	Jobs int
+	// QueueSize is how many walked files may wait for a worker; when the
+	// queue is full the walk blocks until the workers catch up, so memory
+	// stays flat however fast the tree is walked. Zero means twice Jobs.
+	QueueSize int
+	// IOThreads, if positive, caps how many workers may open or read a
+	// file at the same time, independently of Jobs; the rest hash what
+	// they have read. Zero lets every worker read at once. On spinning
+	// disks 1 or 2, with a BufferSize of several MiB so that each read is
+	// a long sequential run, avoids thrashing the heads; SSDs and NVMe
+	// drives are best left unlimited.
+	IOThreads int
+	// WalkJobs, if above 1, is how many directories a walk may read at
+	// once: the subdirectories of each directory entered are listed and
+	// their entries statted ahead of the walk, which otherwise waits on
+	// one directory at a time and can starve the hashing workers on fast
+	// storage. Files are still visited in the same order. Zero or 1 walks
+	// with filepath.Walk.
+	WalkJobs int
+	// BufferSize is the size in bytes of each worker's read buffer; zero
+	// means DefaultBufferSize.
+	BufferSize int
+	// Retries is how many more times a file is read after failing with an
+	// error that may be transient, such as a stale NFS handle; missing
+	// files and denied access are never retried. The wait starts at
+	// RetryDelay, or DefaultRetryDelay if that is zero, and doubles
+	// with each retry.
+	Retries    int
+	RetryDelay time.Duration
+	// Mmap hashes files of at least MmapThreshold bytes by mapping them
+	// into memory, which can be faster on fast storage since the data is
+	// not copied into a buffer first. Platforms without mmap, and files
+	// that cannot be mapped, are read as usual. A mapped file that is
+	// truncated while it is hashed crashes the process, so this is off
+	// by default.
+	Mmap bool
+	// Excludes are glob patterns of paths to skip; see matchesAny.
+	Excludes []string
+	// Includes, if non-empty, restricts hashing to files matching at least
+	// one of these glob patterns. Excludes still win, and directories are
+	// always entered.
+	Includes []string
+	// Extensions, if non-empty, restricts hashing to files with one of
+	// these extensions, given with or without the leading dot and
+	// compared case-insensitively. It combines with Includes.
+	Extensions []string
+	// IgnoreFile names a gitignore-style file that a walk reads from each
+	// directory it enters, skipping the paths it matches below that
+	// directory. Empty disables ignore files.
+	IgnoreFile string
+	// NoPrune keeps entries for files that no longer exist.
+	NoPrune bool
+	// Force rehashes every file regardless of stored metadata.
+	Force bool
+	// StableOrder keeps the line order of an existing text or BSD checksum
+	// file, updating entries in place and appending new ones sorted, so
+	// that version control diffs stay small. JSON files are always sorted.
+	StableOrder bool
+	// MetadataOnly records for each file a digest of its key, size and
+	// modtime instead of its contents, under MetadataAlgorithm. No file is
+	// read, so every file is digested on every run; the result detects
+	// added, removed, resized and touched files but not silent content
+	// changes. Algorithm must be empty.
+	MetadataOnly bool
+	// Archives also hashes each member of zip and tar archives, gzipped or
+	// not, under a key joining the archive's key and the member path with
+	// ArchiveSeparator. Members are rehashed only when their archive is,
+	// and kept or pruned along with it. Filters apply to the archive, not
+	// to its members.
+	Archives bool
+	// CaseInsensitive treats keys that differ only in case as the same
+	// file, as they are on the default Windows and macOS filesystems: the
+	// first spelling visited is kept, later ones are skipped with a
+	// warning, and listed files take the spelling found on disk. Leave it
+	// off on case-sensitive volumes, where such files are distinct.
+	CaseInsensitive bool
+	// StripPrefix is removed from the start of every key, and AddPrefix
+	// then prepended to it, so that a checksum file can be keyed as if
+	// the tree were mounted elsewhere; Verify undoes both to find the
+	// files. Both are slash-separated relative paths. A file whose key
+	// does not start with StripPrefix fails the scan.
+	StripPrefix string
+	AddPrefix   string
+	// HomeRelative keys the files of a directory below the user's home
+	// directory by their path from home, as ~/path, so that a checksum
+	// file stays valid on machines whose home directories differ. Such
+	// keys are resolved against the home directory of the run that reads
+	// them. A directory outside home keeps its usual keys.
+	HomeRelative bool
+	// NulTerminated ends the lines of a text, BSD or SFV checksum file
+	// with NUL instead of newline, as md5sum -z does, so that paths holding
+	// newlines or other unusual bytes are written as they are. Reading
+	// detects such files whatever this is set to.
+	NulTerminated bool
+	// CRLF ends the lines of a text, BSD or SFV checksum file with CR LF
+	// instead of a bare newline, for Windows tools and verifiers that
+	// expect it. Reading accepts either whatever this is set to.
+	CRLF bool
+	// BinaryMarker writes text entries in the binary-mode form of md5sum
+	// -b, "<digest> *<path>", instead of the text-mode "<digest>  <path>".
+	// Both verify alike with md5sum -c, since every file is hashed byte
+	// for byte, and reading accepts either whatever this is set to.
+	BinaryMarker bool
+	// Stats times every file hashed and summarizes the timings in
+	// Result.Stats. Timing is skipped entirely when it is off.
+	Stats bool
+	// HashEmptyAsConstant records files that stat as empty with the digest
+	// of no input, such as MD5's d41d8cd98f00b204e9800998ecf8427e, without
+	// opening them. Pseudo-files that report a size of zero but have
+	// content are then mis-recorded, so it is off by default.
+	HashEmptyAsConstant bool
+	// VerifyOutput reads the checksum file back after writing it and
+	// fails the scan if it does not hold exactly the entries written,
+	// catching encoding bugs with unusual file names. With Stream only
+	// the keys can be compared.
+	VerifyOutput bool
+	// Stream writes the entries of a text, BSD or SFV checksum file as the
+	// scan decides them, spilling sorted runs to temporary files and
+	// merging them, instead of building the new set of entries in memory;
+	// the file written is the same. Result.Checksums is left nil. PerDir,
+	// DetectRenames, StableOrder and Database are not supported with it.
+	Stream bool
+	// Database, if set, keeps the entries in the SQLite database at this
+	// path instead of the checksum file at Output, looking each file up
+	// as it is reached rather than loading every entry, for trees of
+	// millions of files. Records always carry size, modtime and mode.
+	// Archives, PerDir, DetectRenames, StableOrder, CaseInsensitive,
+	// WriteHeader, Format and VerifyOutput are not supported with it.
+	Database string
+	// PerDir keeps a checksum file named like the base name of Output in
+	// every directory of a single scanned tree instead of one file at
+	// Output, each listing the files of its own directory relative to
+	// it, as GNU md5sum would. Result keys stay relative to the scanned
+	// directory, and only the files whose entries changed are rewritten.
+	// Finding the existing files costs an extra walk of the tree.
+	PerDir bool
+	// WriteHeader records in the checksum file the tool version, when it
+	// was written and the directories scanned, as comment lines in the
+	// line-based formats. The file is only rewritten when an entry
+	// changes, so the recorded time is that of the last change.
+	WriteHeader bool
+	// DetectRenames reports an added file whose digest, and size if
+	// recorded, matches a removed entry as a rename of it.
+	DetectRenames bool
+	// AllowCorrupt proceeds with the entries that could be parsed when the
+	// existing checksum file is corrupt, instead of returning its
+	// *CorruptError. Lines that were not understood are lost when the
+	// file is rewritten.
+	AllowCorrupt bool
+	// FailOnError leaves the checksum and timestamp files untouched and
+	// returns a *FailedError if any file could not be read.
+	FailOnError bool
+	// FailFast is FailOnError that stops the scan at the first file or
+	// directory that cannot be read, instead of hashing everything else
+	// and reporting every failure in Result.Failed. Only the failures met
+	// before the walk and the hashing wind down are reported, and the
+	// error returned wraps the FileError the scan stopped at.
+	FailFast bool
+	// FlushEvery and FlushInterval, if positive, rewrite the checksum file
+	// with the entries so far after every FlushEvery files hashed and once
+	// FlushInterval has passed since the last write, so that a run killed
+	// partway leaves a valid file holding most of its work. Nothing is
+	// pruned until the end. With the JSON format, which records sizes and
+	// modtimes, a rerun skips the files already hashed. They apply to a
+	// single checksum file only, and not with FailOnError or FailFast.
+	FlushEvery    int
+	FlushInterval time.Duration
+	// RehashOlderThan, if positive, rehashes every file whose entry was
+	// last hashed longer ago than this, even if it looks unchanged, so
+	// that silent corruption is caught. It requires the JSON format.
+	RehashOlderThan time.Duration
+	// ChunkIndex records, for each file of at least ChunkMinSize bytes
+	// (DefaultChunkMinSize if not positive), an index of its
+	// content-defined chunks: the xxHash64 of each and the state of the
+	// file's hash after it. When such a file changes, the chunks it still
+	// starts with are only checksummed, about three times faster than
+	// hashing them with MD5, and its hash resumes after the last of them;
+	// everything from the first changed chunk on is hashed as usual.
+	// Every byte is still read, those of the first changed chunk twice,
+	// and since a digest cannot skip ahead, a change near the start of a
+	// file saves nothing; it suits large files changed towards their end,
+	// such as growing logs. A chunk changed without changing its
+	// xxHash64, which is not cryptographic, would go unnoticed. It
+	// requires the JSON format and an algorithm whose state can be saved,
+	// which excludes blake3 and combined algorithms.
+	ChunkIndex   bool
+	ChunkMinSize int64
+	// Since, if set, replaces the last run time: a file with an entry is
+	// rehashed only if its modtime is after Since, whatever its stored
+	// size and modtime say. Files without an entry are always hashed.
+	// The timestamp file is left as it was.
+	Since time.Time
+	// TimestampFile is the marker whose modtime records the last run.
+	// Empty means MD5TimestampFile inside each scanned directory; when
+	// set, every directory of the scan shares it.
+	TimestampFile string
+	// NoTimestamp neither reads nor writes a timestamp file. Entries
+	// without a stored size and modtime cannot then be judged by the last
+	// run time, so every such file is rehashed and compared by content,
+	// which is slower but leaves nothing behind in the scanned tree.
+	NoTimestamp bool
+	// FollowSymlinks hashes the target of each symlink and descends into
+	// symlinked directories; otherwise symlinks are skipped. The choice is
+	// recorded in the checksum file header.
+	FollowSymlinks bool
+	// MaxDepth, if positive, is how many directory levels a walk visits:
+	// 1 means only the files directly in the root, 2 adds those in its
+	// subdirectories, and so on. Entries below the limit are kept.
+	MaxDepth int
+	// MaxFileSize and MinFileSize, if positive, skip files larger or
+	// smaller than this many bytes, as Excludes would, and list them in
+	// Result.SkippedBySize.
+	MaxFileSize int64
+	MinFileSize int64
+	// MinAge, if positive, defers files modified less than this long ago,
+	// which may still be being written, to a later run: they are neither
+	// hashed nor pruned, keep whatever entry they had, and are listed in
+	// Result.Deferred. The last run time is not advanced past them.
+	MinAge time.Duration
+	// Files, if non-nil, lists the paths relative to the scan root to hash
+	// instead of walking the tree. It requires a single directory. Entries
+	// for other paths are left untouched: nothing is pruned and the last
+	// run time is not advanced.
+	Files []string
+	// GitRange, if set, hashes only the files that git diff lists as
+	// changed in this revision range, such as main..HEAD, below a single
+	// directory inside a git work tree, as if they were listed in Files.
+	// Entries of files the range deleted or renamed away are pruned; other
+	// entries are left untouched.
+	GitRange string
+	// SignKey, if set, signs the checksum file whenever it is written, and
+	// whenever its signature is missing or does not match, into a detached
+	// signature named with SignatureSuffix; see SignFile. VerifyKey, if
+	// set, makes Verify check that signature before trusting any entry.
+	// Both need a single checksum file.
+	SignKey   ed25519.PrivateKey
+	VerifyKey ed25519.PublicKey
+	// VerifyCheckpoint, if set, names a file in which Verify records each
+	// entry it has confirmed, so that a run cut short can be restarted
+	// without rehashing them. The checkpoint is tied to the checksum file's
+	// path, size, and modification time and ignored if any of them differ;
+	// it is deleted once a run completes. It needs a single checksum file.
+	VerifyCheckpoint string
+	// VerifySample, if positive, makes Verify check only this percentage
+	// of the entries, rounded up, picked at random with SampleSeed, or
+	// with a random seed reported in VerifyResult.Seed if that is zero.
+	// Archive members go with their archive. Files on disk are not
+	// searched for unlisted ones.
+	VerifySample float64
+	SampleSeed   int64
+	// TouchUnchanged makes Verify set the HashedAt of every entry that
+	// matched to when it was checked, and rewrite the checksum file once
+	// every entry has been checked, so that it records when each file was
+	// last confirmed without touching the files themselves.
+	// RehashOlderThan then counts from that check. It needs a single local
+	// JSON checksum file, and SignKey to re-sign one with VerifyKey.
+	TouchUnchanged bool
+	// Reference, if set, is read for the previous checksums instead of
+	// Output, which is still where a scan writes its result. It is a path
+	// or an http or https URL, fetched with a timeout of FetchTimeout, or
+	// DefaultFetchTimeout if that is zero. Verify checks the tree against
+	// it. PerDir and Database are not supported with it.
+	Reference    string
+	FetchTimeout time.Duration
+	// EmptyDirs records each empty directory as an entry whose key ends in
+	// a slash and whose digest is all zeros, so that a directory left
+	// empty is tracked like a file. Its entry is pruned once the directory
+	// is gone or holds files. Verify checks that every such entry is still
+	// a directory, and with EmptyDirs also lists empty directories that
+	// have none. PerDir and Database are not supported with it.
+	EmptyDirs bool
+	// DeleteEmpty deletes the checksum file instead of writing it when no
+	// entries are left, and deletes an existing one that has none, rather
+	// than keeping a file that lists nothing.
+	DeleteEmpty bool
+	// DryRun performs the full walk and hashing but never writes the
+	// checksum file or the timestamp file.
+	DryRun bool
+	// Progress, if non-nil, is updated as files are hashed or skipped.
+	Progress *Progress
+	// Logger receives progress messages; nil discards them. It is called
+	// from several goroutines at once, so a Logger whose writer is shared
+	// with other output should serialize its writes.
+	Logger *log.Logger
+	// LogLevel selects which messages reach Logger.
+	LogLevel LogLevel
+
+	// pruneListed drops the entries of listed paths that no longer
+	// exist, and of everything below them, so that a watch can track
+	// removals.
+	pruneListed bool
+	// stop cancels the scan with the error that ends it, with FailFast.
+	stop context.CancelCauseFunc
+}
+
+// Result describes a completed scan.
+type Result struct {
+	// Output is the absolute path of the checksum file.
+	Output string
+	// Algorithm is the hash every entry was computed with.
+	Algorithm string
+	// Checksums holds every entry after the scan.
+	Checksums map[string]Record
+	// Changed reports whether the checksum file differs from the scan
+	// result and so was, or in a dry run would have been, rewritten.
+	Changed bool
+	// Written reports whether the checksum file was rewritten.
+	Written bool
+	// Deleted reports whether the checksum file was deleted for having no
+	// entries, with Scanner.DeleteEmpty.
+	Deleted bool
+	// Entries is the number of entries after the scan.
+	Entries int
+	// Processed counts files whose digest changed or was added.
+	Processed int
+	// BytesHashed is the number of bytes read while hashing, and
+	// BytesSkipped the total size of the files left alone as unchanged.
+	BytesHashed  int64
+	BytesSkipped int64
+	// BytesResumed is the part of BytesHashed that, with
+	// Scanner.ChunkIndex, was only checksummed, the files' hashes resuming
+	// after it from their chunk indexes.
+	BytesResumed int64
+	// Added, Modified and Removed list the keys of entries that were new,
+	// changed digest, or were pruned. Each is sorted.
+	Added    []string
+	Modified []string
+	Removed  []string
+	// Renamed lists the added entries that carry the digest of a removed
+	// one, when DetectRenames is set. Such pairs are left out of Added and
+	// Removed.
+	Renamed []Rename
+	// Unstable lists the keys of files that changed while they were being
+	// hashed, even after a retry. Their entries may not match the files.
+	Unstable []string
+	// SizeOnly lists the keys of files whose size differs from their
+	// entry although their modtime does not, which suggests a tool that
+	// alters content but preserves modtimes. They are rehashed like any
+	// other change.
+	SizeOnly []string
+	// SkippedBySize lists the keys of files skipped for being outside
+	// Scanner.MinFileSize and Scanner.MaxFileSize. Like excluded files,
+	// their entries are pruned. It is sorted.
+	SkippedBySize []string
+	// Deferred lists the keys of files left for a later run for being
+	// younger than Scanner.MinAge. It is sorted.
+	Deferred []string
+	// Empty counts the files hashed by the scan that were empty. An empty
+	// file gets the algorithm's digest of no input; a read that fails
+	// partway is reported in Failed instead.
+	Empty int
+	// Failed lists the files and directories that could not be read,
+	// sorted by path. Their entries keep whatever state they had before
+	// the scan.
+	Failed []FileError
+	// UnreadableDirs lists the keys of the directories in Failed that
+	// could not be listed, so that nothing below them was scanned. It is
+	// sorted.
+	UnreadableDirs []string
+	// HardLinks lists the files that were not read because they are hard
+	// links to a file hashed by the same scan, whose digest they were
+	// given. It is sorted by Path. Only Unix systems report hard links.
+	HardLinks []HardLink
+	// Duration is the time spent walking and hashing.
+	Duration time.Duration
+	// Stats summarizes how long files took to hash, if Scanner.Stats was
+	// set and any file was hashed.
+	Stats *HashStats
+}
+
+// FileError records why a file or directory could not be read. It is
+// used as a value, so errors.As finds one with a FileError variable as
+// target, not a *FileError.
+type FileError struct {
+	// Path is relative to the scan root, like a checksum file key.
+	Path string
+	Err  error
+}
+
+func (e FileError) Error() string {
+	return e.Path + ": " + e.Err.Error()
+}
+
+func (e FileError) Unwrap() error {
+	return e.Err
+}
+
+// LogLevel controls how much a Scanner logs.
+type LogLevel int
+
+const (
+	// LogNormal logs errors, warnings and once-per-run messages.
+	LogNormal LogLevel = iota
+	// LogVerbose also logs every file checked or skipped.
+	LogVerbose
+	// LogQuiet logs errors only.
+	LogQuiet
+)
+
+func (s *Scanner) errorf(format string, args ...any) {
+	if s.Logger != nil {
+		s.Logger.Printf(format, args...)
+	}
+}
+
+func (s *Scanner) logf(format string, args ...any) {
+	if s.LogLevel != LogQuiet {
+		s.errorf(format, args...)
+	}
+}
+
+func (s *Scanner) tracef(format string, args ...any) {
+	if s.LogLevel == LogVerbose {
+		s.errorf(format, args...)
+	}
+}
+
+// failFast stops the scan at fe, the first file or directory that could
+// not be read, if FailFast is set. Later calls have no effect.
+func (s *Scanner) failFast(fe FileError) {
+	if s.stop != nil {
+		s.stop(fe)
+	}
+}
+
+// stoppedAt returns the error a FailFast scan with ctx stopped at, naming
+// output as left untouched, or nil if it was not stopped by an error.
+func (s *Scanner) stoppedAt(ctx context.Context, output string) error {
+	var fe FileError
+	if s.stop == nil || !errors.As(context.Cause(ctx), &fe) {
+		return nil
+	}
+	return fmt.Errorf("stopped at the first error, %s left untouched: %w", output, fe)
+}
+
+// countHashed records a hashed file in s.Progress.
+func (s *Scanner) countHashed(bytes int64) {
+	if s.Progress != nil {
+		s.Progress.Hashed.Add(1)
+		s.Progress.Bytes.Add(bytes)
+	}
+}
+
+// countQueued records in s.Progress a file of size bytes sent to be
+// hashed.
+func (s *Scanner) countQueued(size int64) {
+	if s.Progress != nil {
+		s.Progress.Queued.Add(1)
+		s.Progress.QueuedBytes.Add(size)
+	}
+}
+
+// walked records in s.Progress that every file has been queued.
+func (s *Scanner) walked() {
+	if s.Progress != nil {
+		s.Progress.Walked.Store(true)
+	}
+}
+
+// algorithm returns the algorithm to hash with when writing format.
+func (s *Scanner) algorithm(format string) string {
+	switch {
+	case s.MetadataOnly:
+		return MetadataAlgorithm
+	case s.Algorithm != "":
+		return s.Algorithm
+	case format == FormatSFV:
+		return sfvAlgorithm
+	}
+	return DefaultAlgorithm
+}
+
+func (s *Scanner) jobs() int {
+	if s.Jobs <= 0 {
+		return runtime.NumCPU()
+	}
+	return s.Jobs
+}
+
+func (s *Scanner) queueSize() int {
+	if s.QueueSize <= 0 {
+		return 2 * s.jobs()
+	}
+	return s.QueueSize
+}
+
+// readOptions returns how the workers of a scan or verification read.
+func (s *Scanner) readOptions() readOptions {
+	opts := readOptions{
+		bufSize:       s.bufferSize(),
+		limit:         newIOLimiter(s.IOThreads),
+		retries:       s.Retries,
+		retryDelay:    s.RetryDelay,
+		emptyConstant: s.HashEmptyAsConstant,
+		timed:         s.Stats,
+	}
+	if s.Mmap {
+		opts.mmapMin = MmapThreshold
+	}
+	if opts.retryDelay <= 0 {
+		opts.retryDelay = DefaultRetryDelay
+	}
+	return opts
+}
+
+func (s *Scanner) chunkMinSize() int64 {
+	if s.ChunkMinSize <= 0 {
+		return DefaultChunkMinSize
+	}
+	return s.ChunkMinSize
+}
+
+func (s *Scanner) bufferSize() int {
+	if s.BufferSize <= 0 {
+		return DefaultBufferSize
+	}
+	return s.BufferSize
+}
+
+func (s *Scanner) format(outputPath string) string {
+	if s.Format != "" {
+		return s.Format
+	}
+	if strings.EqualFold(dataExt(outputPath), ".json") {
+		return FormatJSON
+	}
+	if isSFV(outputPath) {
+		return FormatSFV
+	}
+	return FormatText
+}
+
+// validate checks the options shared by Scan and Verify.
+func (s *Scanner) validate() error {
+	if s.Output == "" && s.Database == "" {
+		return errors.New("no output path")
+	}
+	for _, pattern := range s.Excludes {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid exclude pattern %q: %w", pattern, err)
+		}
+	}
+	for _, pattern := range s.Includes {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid include pattern %q: %w", pattern, err)
+		}
+	}
+	return nil
+}
+
+// resolve returns the scan roots and the absolute output path.
+func (s *Scanner) resolve(dirs []string) ([]root, string, error) {
+	roots, err := resolveRoots(dirs)
+	if err != nil {
+		return nil, "", err
+	}
+	strip, err := cleanPrefix(s.StripPrefix)
+	if err != nil {
+		return nil, "", err
+	}
+	add, err := cleanPrefix(s.AddPrefix)
+	if err != nil {
+		return nil, "", err
+	}
+	if (strip != "" || add != "" || s.HomeRelative) && s.PerDir {
+		return nil, "", errors.New("key prefixes cannot be used with per-directory checksum files")
+	}
+	if s.HomeRelative {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, "", fmt.Errorf("cannot key paths by the home directory: %w", err)
+		}
+		for i := range roots {
+			label, ok := homeLabel(home, roots[i].dir)
+			if !ok {
+				s.logf("%s is not below %s, keeping its keys relative to it", roots[i].dir, home)
+				continue
+			}
+			roots[i].label = label
+		}
+	}
+	if s.NoTimestamp && s.TimestampFile != "" {
+		return nil, "", errors.New("a timestamp file cannot be given when timestamps are disabled")
+	}
+	for i := range roots {
+		roots[i].strip, roots[i].add = strip, add
+		roots[i].timestamp = filepath.Join(roots[i].dir, MD5TimestampFile)
+		if s.TimestampFile != "" {
+			timestamp, err := filepath.Abs(s.TimestampFile)
+			if err != nil {
+				return nil, "", fmt.Errorf("invalid timestamp file: %w", err)
+			}
+			roots[i].timestamp = timestamp
+		}
+	}
+
+	if s.Output == StdoutPath {
+		if s.PerDir {
+			return nil, "", errors.New("per-directory checksum files cannot go to standard output")
+		}
+		return roots, StdoutPath, nil
+	}
+	outputPath, err := filepath.Abs(s.Output)
+	if err != nil {
+		return nil, "", fmt.Errorf("invalid output path: %w", err)
+	}
+	return roots, outputPath, nil
+}
+
+// Scan updates the checksum file for dir. It is ScanContext with a
+// background context.
+func (s *Scanner) Scan(dir string) (Result, error) {
+	return s.ScanContext(context.Background(), dir)
+}
+
+// ScanContext updates the checksum file for dir. It is ScanDirsContext
+// with a single directory.
+func (s *Scanner) ScanContext(ctx context.Context, dir string) (Result, error) {
+	return s.ScanDirsContext(ctx, []string{dir})
+}
+
+// ScanDirsContext walks dirs, hashes the files that changed since the last
+// run and rewrites the checksum file if any entry changed. With more than
+// one directory, keys are prefixed with the directory as given, and each
+// directory keeps its own timestamp and lock file. A single regular file
+// in place of the directories is hashed alone, keyed by its name, as if
+// listed in Files for its parent directory; the other entries of the
+// checksum file are kept. If ctx is cancelled the walk stops, whatever was
+// hashed is still saved, and the partial Result is returned together with
+// ctx.Err().
+func (s *Scanner) ScanDirsContext(ctx context.Context, dirs []string) (Result, error) {
+	if err := s.validate(); err != nil {
+		return Result{}, err
+	}
+	if s.FailFast && s.stop == nil {
+		ctx, cancel := context.WithCancelCause(ctx)
+		defer cancel(nil)
+		fast := *s
+		fast.stop = cancel
+		return fast.ScanDirsContext(ctx, dirs)
+	}
+	if s.GitRange != "" {
+		if len(dirs) != 1 || s.Files != nil {
+			return Result{}, errors.New("a git range requires a single directory and no file list")
+		}
+		files, err := gitChangedFiles(ctx, dirs[0], s.GitRange)
+		if err != nil {
+			return Result{}, err
+		}
+		s.logf("%d files changed in %s", len(files), s.GitRange)
+		listed := *s
+		listed.GitRange = ""
+		listed.Files = files
+		listed.pruneListed = true
+		return listed.ScanDirsContext(ctx, dirs)
+	}
+	if len(dirs) == 1 && s.Files == nil {
+		if info, err := os.Stat(dirs[0]); err == nil && info.Mode().IsRegular() {
+			if s.PerDir {
+				return Result{}, errors.New("per-directory checksum files require a directory")
+			}
+			s.logf("%s is a file, hashing it alone", dirs[0])
+			single := *s
+			single.Files = []string{filepath.Base(dirs[0])}
+			single.pruneListed = true
+			return single.ScanDirsContext(ctx, []string{filepath.Dir(dirs[0])})
+		}
+	}
+	if s.Files != nil && len(dirs) != 1 {
+		return Result{}, errors.New("a file list requires a single directory")
+	}
+	if s.PerDir && len(dirs) != 1 {
+		return Result{}, errors.New("per-directory checksum files require a single directory")
+	}
+	roots, outputPath, err := s.resolve(dirs)
+	if err != nil {
+		return Result{}, err
+	}
+	format := s.format(outputPath)
+	if !validFormat(format) {
+		return Result{}, fmt.Errorf("unsupported format: %s", format)
+	}
+	algo := s.algorithm(format)
+	if format == FormatSFV && algo != sfvAlgorithm {
+		return Result{}, fmt.Errorf("the sfv format holds %s checksums, not %s", sfvAlgorithm, algo)
+	}
+	if format == FormatBSD && strings.Contains(algo, AlgorithmSeparator) {
+		return Result{}, fmt.Errorf("the bsd format names one algorithm per entry, not %s", algo)
+	}
+	newHash, err := newHashFor(algo)
+	if err != nil {
+		return Result{}, err
+	}
+	if s.MetadataOnly && s.Algorithm != "" {
+		return Result{}, errors.New("a metadata-only scan reads no content to hash with an algorithm")
+	}
+	if s.RehashOlderThan > 0 && format != FormatJSON && s.Database == "" {
+		return Result{}, errors.New("rehashing by age requires the JSON format, which records when each entry was hashed")
+	}
+	if s.ChunkIndex && (format != FormatJSON || s.Database != "") {
+		return Result{}, errors.New("a chunk index requires a JSON checksum file, which holds it with each entry")
+	}
+	if s.ChunkIndex && !resumable(newHash()) {
+		return Result{}, fmt.Errorf("a chunk index needs an algorithm whose state can be saved, not %s", algo)
+	}
+
+	if !s.DryRun {
+		for _, r := range roots {
+			unlock, err := acquireLock(r.lock)
+			if err != nil {
+				return Result{}, err
+			}
+			defer unlock()
+		}
+	}
+
+	if s.VerifyOutput && outputPath == StdoutPath {
+		return Result{}, errors.New("standard output cannot be read back to verify it")
+	}
+	if s.NulTerminated && format == FormatJSON {
+		return Result{}, errors.New("NUL-terminated lines require a text, BSD or SFV format")
+	}
+	if s.CRLF && (format == FormatJSON || s.NulTerminated) {
+		return Result{}, errors.New("CRLF line endings require a newline-terminated text, BSD or SFV format")
+	}
+	flushing := s.FlushEvery > 0 || s.FlushInterval > 0
+	if flushing && (s.PerDir || s.Stream || s.Database != "" || outputPath == StdoutPath || s.FailOnError || s.FailFast) {
+		return Result{}, errors.New("periodic flushes need a single checksum file, without streaming, a database, fail-on-error or fail-fast")
+	}
+	if s.SignKey != nil && (s.PerDir || s.Database != "" || outputPath == StdoutPath) {
+		return Result{}, errors.New("signing needs a single checksum file, not per-directory files, a database or standard output")
+	}
+	if s.Reference != "" && (s.PerDir || s.Database != "") {
+		return Result{}, errors.New("a reference needs a single checksum file, not per-directory files or a database")
+	}
+	if IsSharded(outputPath) && (s.Stream || s.SignKey != nil || s.PerDir || s.Database != "") {
+		return Result{}, errors.New("a sharded checksum file cannot be streamed, signed, or kept per directory or in a database")
+	}
+	if s.EmptyDirs && (s.PerDir || s.Database != "") {
+		return Result{}, errors.New("recording empty directories needs a single checksum file, not per-directory files or a database")
+	}
+	if s.Stream && (format == FormatJSON || s.PerDir || s.DetectRenames || s.StableOrder || s.Database != "") {
+		return Result{}, errors.New("streaming supports text, BSD and SFV files only, without per-directory files, rename detection, stable order or a database")
+	}
+
+	if s.Database != "" {
+		if err := s.checkDatabaseOptions(); err != nil {
+			return Result{}, err
+		}
+		return s.scanDatabase(ctx, roots, algo, newHash)
+	}
+
+	header := Header{Algorithm: algo, FollowSymlinks: s.FollowSymlinks, NulTerminated: s.NulTerminated, CRLF: s.CRLF, Binary: s.BinaryMarker && format == FormatText}
+	if s.WriteHeader {
+		header.Generator = "incremental-md5 " + Version
+		header.Generated = time.Now().UTC().Truncate(time.Second)
+		for _, r := range roots {
+			header.Roots = append(header.Roots, r.dir)
+		}
+	}
+	var existingChecksums map[string]Record
+	var existingHeader Header
+	var perDir perDirFiles
+	if s.PerDir {
+		existingChecksums, existingHeader, perDir, err = s.readPerDir(ctx, roots[0], filepath.Base(outputPath), algo)
+		if err != nil {
+			return Result{}, err
+		}
+	} else if outputPath == StdoutPath && s.Reference == "" {
+		// There is no previous listing, so every file is hashed.
+		existingChecksums, existingHeader = make(map[string]Record), header
+	} else {
+		if s.Reference != "" {
+			existingChecksums, existingHeader, err = s.readReference(ctx)
+		} else {
+			existingChecksums, existingHeader, err = ReadChecksums(outputPath)
+		}
+		if err != nil {
+			if !s.AllowCorrupt {
+				return Result{}, err
+			}
+			s.errorf("WARNING: %v; continuing with the %d entries that could be read", err, len(existingChecksums))
+		}
+	}
+	if len(existingChecksums) > 0 && existingHeader.Algorithm != algo {
+		s.logf("WARNING: %s was written with %s, recomputing all entries with %s", outputPath, existingHeader.Algorithm, algo)
+		existingChecksums = make(map[string]Record)
+	}
+	// With a stream, entries go to it as they are decided and
+	// newChecksums stays empty.
+	var stream *entryStream
+	if s.Stream {
+		stream, err = newEntryStream()
+		if err != nil {
+			return Result{}, err
+		}
+		defer stream.close()
+	}
+	newChecksums := make(map[string]Record)
+	if stream == nil {
+		for k, v := range existingChecksums {
+			if format != FormatJSON {
+				v = Record{Hash: v.Hash}
+			}
+			newChecksums[k] = v
+		}
+	}
+
+	changed := false
+	var added, modified, removed []string
+	// Older versions hashed the checksum file into itself; such an entry
+	// changes on every write, so it is dropped even when nothing is pruned.
+	for _, r := range roots {
+		rel, err := filepath.Rel(realPath(r.dir), realPath(outputPath))
+		if err != nil || !filepath.IsLocal(rel) {
+			continue
+		}
+		if key := r.key(rel); fileExistsInChecksums(key, existingChecksums) {
+			s.logf("Dropping entry for the checksum file %s", key)
+			delete(newChecksums, key)
+			if stream != nil {
+				stream.drop(key)
+			}
+			removed = append(removed, key)
+			changed = true
+		}
+	}
+	if existingFormat := DetectFormat(outputPath); existingFormat != "" && existingFormat != format {
+		s.logf("Converting %s from %s to %s", outputPath, existingFormat, format)
+		changed = true
+	}
+	if len(existingChecksums) > 0 && (existingHeader.FollowSymlinks != s.FollowSymlinks || (existingHeader.Generator != "") != s.WriteHeader ||
+		existingHeader.NulTerminated != s.NulTerminated || existingHeader.CRLF != s.CRLF || existingHeader.Binary != header.Binary) {
+		changed = true
+	}
+	neededUpdate := false
+	var bytesHashed, bytesSkipped, bytesResumed int64
+	var failed []FileError
+	var unstable, sizeOnly, bySize, deferred, unreadableDirs []string
+	var empty int
+	var timings []FileTiming
+	// firstLink maps each hard-linked file queued for hashing to its key,
+	// and hardLinks lists the other links to it, which wait for its
+	// result instead of being read again.
+	firstLink := make(map[linkID]string)
+	var hardLinks []HardLink
+	// emptyDirs holds the keys and info of the empty directories without
+	// an entry, recorded once the walk is over.
+	var emptyDirs []memberSum
+	// linkResults holds the results of hard-linked files by key.
+	linkResults := make(map[string]hashResult)
+	seen := make(map[string]bool)
+	var unreadable []string
+	var walkFailed []FileError
+	processingStart := time.Now()
+
+	// dirty reports that entries changed since the file was last flushed.
+	dirty := false
+	// record stores the digest of the file or archive member at key,
+	// computed at hashedAt, with its chunk index if it has one.
+	record := func(key, sum string, info os.FileInfo, hashedAt time.Time, chunks []Chunk) {
+		rec := Record{Hash: sum}
+		if format == FormatJSON {
+			rec.Size = info.Size()
+			rec.ModTime = info.ModTime()
+			rec.Mode = permBits(info)
+			rec.HashedAt = hashedAt
+			if id, ok := fileID(info); ok {
+				rec.Device, rec.Inode = id.dev, id.ino
+			}
+			rec.Chunks = chunks
+		}
+		if stream != nil {
+			stream.add(key, rec.Hash)
+		}
+		existing, exists := existingChecksums[key]
+		if exists && existing.Hash != rec.Hash && !existing.ModTime.IsZero() &&
+			existing.Size == rec.Size && existing.ModTime.Equal(rec.ModTime) {
+			s.errorf("WARNING: %s changed content without changing size or modtime", key)
+		}
+		if !existing.equal(rec) {
+			changed = true
+			dirty = true
+			if stream == nil {
+				newChecksums[key] = rec
+			}
+			switch {
+			case !exists:
+				added = append(added, key)
+			case existing.Hash != rec.Hash:
+				modified = append(modified, key)
+			}
+		}
+	}
+	flush := func() {
+		var order []string
+		if s.StableOrder {
+			order = readOrder(outputPath)
+		}
+		if err := writeChecksums(outputPath, newChecksums, header, format, order); err != nil {
+			s.errorf("WARNING: cannot save progress to %s - %v", outputPath, err)
+			return
+		}
+		s.tracef("Saved progress to %s, %d entries", outputPath, len(newChecksums))
+		dirty = false
+	}
+	// byInode maps the device and inode of each entry to its key, to
+	// recognize files that were renamed.
+	byInode := make(map[linkID]string)
+	for key, rec := range existingChecksums {
+		if rec.Inode != 0 {
+			byInode[linkID{dev: rec.Device, ino: rec.Inode}] = key
+		}
+	}
+	// rehashed holds the archives whose members were hashed, and members
+	// the keys of those members.
+	rehashed := make(map[string]bool)
+	members := make(map[string]bool)
+
+	w := newWalker(s, roots, outputPath)
+	if s.PerDir {
+		w.ownName = filepath.Base(outputPath)
+	}
+	pending := make(chan hashJob, s.queueSize())
+	opts := s.readOptions()
+	if s.ChunkIndex {
+		opts.chunkMin = s.chunkMinSize()
+	}
+	results := hashWorkers(ctx, s.jobs(), opts, newHash, pending)
+	collected := make(chan struct{})
+	go func() {
+		defer close(collected)
+		hashed, lastFlush := 0, time.Now()
+		for res := range results {
+			s.countHashed(res.bytes)
+			bytesHashed += res.bytes
+			bytesResumed += res.resumed
+			if s.Stats && res.reuse == nil {
+				timings = append(timings, FileTiming{Path: res.relPath, Bytes: res.bytes, Duration: res.elapsed})
+			}
+			if res.linked {
+				linkResults[res.relPath] = res
+			}
+			// A flush saves the results before this one.
+			if flushing && !s.DryRun {
+				hashed++
+				if dirty && ((s.FlushEvery > 0 && hashed%s.FlushEvery == 0) || (s.FlushInterval > 0 && time.Since(lastFlush) >= s.FlushInterval)) {
+					flush()
+					lastFlush = time.Now()
+				}
+			}
+			if res.err != nil {
+				s.errorf("Checksum failed: %s - %v", res.path, res.err)
+				failed = append(failed, FileError{Path: res.relPath, Err: res.err})
+				s.failFast(failed[len(failed)-1])
+				continue
+			}
+			if res.unstable {
+				s.errorf("WARNING: %s changed while being hashed, its checksum may be stale", res.relPath)
+				unstable = append(unstable, res.relPath)
+			}
+
+			if !res.metadata && res.info != nil && res.info.Size() == 0 {
+				empty++
+			}
+			hashedAt, chunks := time.Now(), res.chunks
+			if res.reuse != nil {
+				hashedAt, chunks = res.reuse.HashedAt, res.reuse.Chunks
+			}
+			record(res.relPath, res.sum, res.info, hashedAt, chunks)
+			if res.archive && !res.unstable {
+				rehashed[res.relPath] = true
+				for _, m := range res.members {
+					record(m.key, m.sum, m.info, time.Now(), nil)
+					members[m.key] = true
+				}
+			}
+			neededUpdate = true
+		}
+	}()
+
+	// folded maps the lowercased keys visited to their spelling.
+	folded := make(map[string]string)
+	var prefixErr error
+	if s.CaseInsensitive {
+		s.warnCaseCollisions(outputPath, existingChecksums)
+	}
+	for _, r := range roots {
+		var lastRun time.Time
+		if !s.NoTimestamp {
+			lastRun = getLastRunTime(r.timestamp)
+		}
+		visit := func(path, relPath string, info os.FileInfo) error {
+			if !r.hasPrefix(relPath) {
+				prefixErr = fmt.Errorf("%s does not start with the prefix %s to strip", r.key(relPath), r.strip)
+				return prefixErr
+			}
+			key := r.key(relPath)
+			if info.IsDir() {
+				key += "/"
+				seen[key] = true
+				if existing, exists := existingChecksums[key]; !exists || existing.Hash != emptyDirSum(newHash) {
+					emptyDirs = append(emptyDirs, memberSum{key: key, sum: emptyDirSum(newHash), info: info})
+				} else if stream != nil {
+					stream.add(key, existing.Hash)
+				}
+				return nil
+			}
+			s.tracef("Checking %s", key)
+			if !s.sizeAllowed(info) {
+				s.tracef("Skipping %s, %d bytes is outside the size limits", key, info.Size())
+				bySize = append(bySize, key)
+				return nil
+			}
+			if s.CaseInsensitive {
+				fold := strings.ToLower(key)
+				if other, ok := folded[fold]; ok && other != key {
+					s.errorf("WARNING: %s and %s differ only in case, keeping %s", other, key, other)
+					return nil
+				}
+				folded[fold] = key
+			}
+			seen[key] = true
+			if s.tooYoung(info) {
+				s.tracef("Deferring %s, modified %v ago", key, time.Since(info.ModTime()).Round(time.Millisecond))
+				deferred = append(deferred, key)
+				return nil
+			}
+
+			existing, exists := existingChecksums[key]
+			if exists && sizeOnlyChange(existing, info) {
+				s.warnSizeOnly(key, existing, info)
+				sizeOnly = append(sizeOnly, key)
+			}
+			if !s.Force && !s.MetadataOnly && exists && !s.stale(existing, info, lastRun) && !s.due(existing) {
+				if s.Progress != nil {
+					s.Progress.Skipped.Add(1)
+				}
+				bytesSkipped += info.Size()
+				if stream != nil {
+					stream.add(key, existing.Hash)
+				}
+				return nil
+			}
+			job := hashJob{path: path, relPath: key, info: info, archive: s.Archives && !s.MetadataOnly && isArchive(key), metadata: s.MetadataOnly}
+			if !exists && !s.Force && !job.archive && !job.metadata {
+				job.reuse = s.renamedFrom(key, info, byInode, existingChecksums)
+			}
+			if s.ChunkIndex {
+				job.chunks = existing.Chunks
+			}
+			// A metadata digest covers the key and an archive entry its
+			// members, so neither can be shared between links.
+			if id, ok := fileLink(info); ok && job.reuse == nil && !job.archive && !job.metadata {
+				if first, ok := firstLink[id]; ok {
+					s.tracef("%s is a hard link to %s, reusing its checksum", key, first)
+					hardLinks = append(hardLinks, HardLink{Path: key, LinkOf: first})
+					return nil
+				}
+				firstLink[id] = key
+				job.linked = true
+			}
+			s.countQueued(info.Size())
+			select {
+			case pending <- job:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			return nil
+		}
+		// Entries below a path we could not read must survive pruning.
+		markUnreadable := func(relPath string, err error) {
+			unreadable = append(unreadable, r.key(relPath))
+			var le *listError
+			switch {
+			case errors.As(err, &le):
+				s.errorf("WARNING: cannot list %s, nothing below it was scanned - %v", r.key(relPath), le.Err)
+				unreadableDirs = append(unreadableDirs, r.key(relPath))
+				walkFailed = append(walkFailed, FileError{Path: r.key(relPath), Err: err})
+				s.failFast(walkFailed[len(walkFailed)-1])
+			case err != nil:
+				s.errorf("Cannot read %s - %v", r.key(relPath), err)
+				walkFailed = append(walkFailed, FileError{Path: r.key(relPath), Err: err})
+				s.failFast(walkFailed[len(walkFailed)-1])
+			}
+		}
+		if s.Files != nil {
+			w.visitList(ctx, r.dir, s.Files, visit, markUnreadable)
+		} else {
+			w.walk(ctx, r.dir, visit, markUnreadable)
+		}
+	}
+	s.walked()
+	close(pending)
+	<-collected
+	if prefixErr != nil {
+		return Result{}, prefixErr
+	}
+	failed = append(failed, walkFailed...)
+	for _, dir := range emptyDirs {
+		s.tracef("Recording empty directory %s", dir.key)
+		record(dir.key, dir.sum, dir.info, time.Now(), nil)
+	}
+	// Each link takes the outcome of the file it links to; one whose file
+	// was never hashed, because the scan was interrupted, keeps its entry.
+	var linked []HardLink
+	for _, link := range hardLinks {
+		res, ok := linkResults[link.LinkOf]
+		switch {
+		case !ok:
+			continue
+		case res.err != nil:
+			failed = append(failed, FileError{Path: link.Path, Err: res.err})
+			continue
+		case res.unstable:
+			unstable = append(unstable, link.Path)
+		}
+		if res.info.Size() == 0 {
+			empty++
+		}
+		record(link.Path, res.sum, res.info, time.Now(), res.chunks)
+		linked = append(linked, link)
+	}
+	sort.Slice(linked, func(i, j int) bool { return linked[i].Path < linked[j].Path })
+
+	// An interrupted walk has not seen every file, so pruning would drop
+	// live entries and advancing the last run time would hide files that
+	// were never visited. Whatever was hashed is still saved below, and
+	// with the JSON format the next run skips those files via their stored
+	// size and modtime.
+	interrupted := ctx.Err() != nil
+	if interrupted && s.stop == nil {
+		s.logf("Interrupted, saving partial results")
+	}
+
+	pruning := !s.NoPrune && !interrupted && (s.Files == nil || s.pruneListed)
+	var gone []string
+	if pruning && s.Files != nil {
+		gone = missingFiles(roots[0], s.Files)
+	}
+	// pruned reports whether the entry for relPath goes.
+	pruned := func(relPath string) bool {
+		if !pruning || seen[relPath] {
+			return false
+		}
+		// A member lives as long as its archive, and as long as it is
+		// still in the archive once that is rehashed.
+		owner := relPath
+		if archive := archiveOf(relPath); s.Archives && archive != "" {
+			owner = archive
+			if members[relPath] || (seen[archive] && !rehashed[archive]) {
+				return false
+			}
+		}
+		if underAny(owner, unreadable) {
+			return false
+		}
+		if s.Files != nil && !underAny(owner, gone) && !rehashed[owner] {
+			return false
+		}
+		return true
+	}
+	if stream == nil {
+		for relPath := range newChecksums {
+			if pruned(relPath) {
+				delete(newChecksums, relPath)
+				removed = append(removed, relPath)
+				changed = true
+			}
+		}
+	} else {
+		// Entries the scan neither visited nor hashed, or failed to hash,
+		// are kept unless pruned.
+		for relPath, rec := range existingChecksums {
+			switch {
+			case stream.added(relPath):
+			case pruned(relPath):
+				removed = append(removed, relPath)
+				changed = true
+			default:
+				stream.add(relPath, rec.Hash)
+			}
+		}
+	}
+
+	sort.Strings(added)
+	sort.Strings(modified)
+	sort.Strings(removed)
+	sort.Strings(unstable)
+	sort.Strings(sizeOnly)
+	sort.Strings(bySize)
+	sort.Strings(deferred)
+	sort.Strings(unreadableDirs)
+	processed := len(added) + len(modified)
+	var renamed []Rename
+	if s.DetectRenames {
+		renamed, added, removed = detectRenames(added, removed, existingChecksums, newChecksums)
+	}
+	if !s.DryRun {
+		for _, rn := range renamed {
+			s.logf("Renamed %s -> %s", rn.From, rn.To)
+		}
+		for _, relPath := range removed {
+			s.logf("Pruning %s", relPath)
+		}
+	}
+	sort.Slice(failed, func(i, j int) bool { return failed[i].Path < failed[j].Path })
+	res := Result{
+		Output:         outputPath,
+		Algorithm:      algo,
+		Checksums:      newChecksums,
+		Entries:        len(newChecksums),
+		Processed:      processed,
+		BytesHashed:    bytesHashed,
+		BytesSkipped:   bytesSkipped,
+		BytesResumed:   bytesResumed,
+		Added:          added,
+		Modified:       modified,
+		Removed:        removed,
+		Renamed:        renamed,
+		Unstable:       unstable,
+		SizeOnly:       sizeOnly,
+		SkippedBySize:  bySize,
+		Deferred:       deferred,
+		UnreadableDirs: unreadableDirs,
+		HardLinks:      linked,
+		Empty:          empty,
+		Failed:         failed,
+		Duration:       time.Since(processingStart),
+		Stats:          newHashStats(timings),
+	}
+
+	if stream != nil {
+		res.Checksums = nil
+		res.Entries = stream.len()
+	}
+	res.Changed = changed || (stream == nil && !mapsEqual(existingChecksums, newChecksums))
+	if err := s.stoppedAt(ctx, outputPath); err != nil {
+		return res, err
+	}
+	if s.FailOnError && len(failed) > 0 && !interrupted {
+		return res, &FailedError{Output: outputPath, Failed: failed}
+	}
+	if s.DryRun {
+		s.logf("Dry run, %s left untouched", outputPath)
+		return res, ctx.Err()
+	}
+
+	if !res.Changed {
+		if interrupted {
+			s.logf("No changes detected. Existing file preserved: %s", outputPath)
+			return res, ctx.Err()
+		}
+		if s.DeleteEmpty && res.Entries == 0 && !s.PerDir {
+			deleted, err := deleteOutput(outputPath)
+			if err != nil {
+				return res, err
+			}
+			res.Deleted = deleted
+		}
+		if res.Deleted {
+			s.logf("Deleted %s, which has no entries", outputPath)
+		} else {
+			s.logf("No changes detected. Existing file preserved: %s", outputPath)
+			if err := s.resign(outputPath); err != nil {
+				return res, err
+			}
+		}
+		if neededUpdate && s.Files == nil && s.Since.IsZero() && !s.NoTimestamp && len(failed) == 0 && len(unstable) == 0 && len(deferred) == 0 && outputPath != StdoutPath {
+			return res, updateLastRuns(roots, s.logf)
+		}
+		return res, nil
+	}
+
+	if s.PerDir {
+		n, err := s.writePerDir(roots[0], filepath.Base(outputPath), existingChecksums, newChecksums, perDir, header, format)
+		res.Written = n > 0
+		if err != nil {
+			return res, err
+		}
+	} else if s.DeleteEmpty && res.Entries == 0 {
+		deleted, err := deleteOutput(outputPath)
+		if err != nil {
+			return res, err
+		}
+		if deleted {
+			s.logf("Deleted %s, which has no entries left", outputPath)
+		}
+		res.Deleted = deleted
+	} else if stream != nil {
+		if err := stream.write(outputPath, header, format); err != nil {
+			return res, err
+		}
+		res.Written = true
+	} else {
+		var order []string
+		if s.StableOrder {
+			order = readOrder(outputPath)
+		}
+		if err := writeChecksums(outputPath, newChecksums, header, format, order); err != nil {
+			return res, err
+		}
+		res.Written = true
+	}
+	if s.VerifyOutput {
+		if err := s.checkOutput(ctx, roots[0], outputPath, algo, newChecksums, stream); err != nil {
+			return res, err
+		}
+	}
+	// The signature covers the file as renamed into place.
+	if s.SignKey != nil && res.Written {
+		if err := SignFile(outputPath, s.SignKey); err != nil {
+			return res, fmt.Errorf("failed to sign %s: %w", outputPath, err)
+		}
+		s.logf("Signed %s", outputPath)
+	}
+	if interrupted {
+		return res, ctx.Err()
+	}
+	// A list or -since covers only part of the tree, so the last run time
+	// must keep describing the previous full walk. Likewise, files that
+	// failed, were caught changing or were deferred must look changed to
+	// the next run even if they keep their modtime. A listing on standard
+	// output describes no file that a later run could rely on.
+	if s.Files != nil || !s.Since.IsZero() || s.NoTimestamp || len(failed) > 0 || len(unstable) > 0 || len(deferred) > 0 || outputPath == StdoutPath {
+		return res, nil
+	}
+	return res, updateLastRuns(roots, func(string, ...any) {})
+}
+
+// resign signs the unchanged checksum file at outputPath if SignKey is
+// set and its signature is missing or was made with another key.
+func (s *Scanner) resign(outputPath string) error {
+	if s.SignKey == nil || outputPath == StdoutPath {
+		return nil
+	}
+	if _, err := os.Stat(outputPath); err != nil {
+		return nil
+	}
+	if VerifyFile(outputPath, s.SignKey.Public().(ed25519.PublicKey)) == nil {
+		return nil
+	}
+	if err := SignFile(outputPath, s.SignKey); err != nil {
+		return fmt.Errorf("failed to sign %s: %w", outputPath, err)
+	}
+	s.logf("Signed %s", outputPath)
+	return nil
+}
+
+// deleteOutput removes the checksum file at path, and any signature of
+// it, reporting whether the file existed. Like a rewrite, the removal is
+// synced to disk.
+func deleteOutput(path string) (bool, error) {
+	if path == StdoutPath {
+		return false, nil
+	}
+	os.Remove(path + SignatureSuffix)
+	if err := os.Remove(path); err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, syncDir(filepath.Dir(path))
+}
+
+// checkOutput reads back the checksum file at outputPath, or the
+// per-directory files below r, and compares their entries with want, or
+// with the keys added to stream if it is set.
+func (s *Scanner) checkOutput(ctx context.Context, r root, outputPath, algo string, want map[string]Record, stream *entryStream) error {
+	var got map[string]Record
+	var err error
+	if s.PerDir {
+		reader := *s
+		reader.AllowCorrupt = false
+		got, _, _, err = reader.readPerDir(ctx, r, filepath.Base(outputPath), algo)
+	} else {
+		got, _, err = ReadChecksums(outputPath)
+	}
+	if err != nil {
+		return fmt.Errorf("%s does not read back as written: %v", outputPath, err)
+	}
+	for key, rec := range got {
+		var ok bool
+		if stream != nil {
+			ok = stream.added(key)
+		} else {
+			written, listed := want[key]
+			ok = listed && written.equal(rec)
+		}
+		if !ok {
+			return fmt.Errorf("%s does not read back as written: unexpected entry %q", outputPath, key)
+		}
+	}
+	n := len(want)
+	if stream != nil {
+		n = stream.len()
+	}
+	if len(got) != n {
+		for key := range want {
+			if _, ok := got[key]; !ok {
+				return fmt.Errorf("%s does not read back as written: entry %q is missing", outputPath, key)
+			}
+		}
+		return fmt.Errorf("%s does not read back as written: %d entries, not %d", outputPath, len(got), n)
+	}
+	return nil
+}
+
+// warnCaseCollisions warns about entries of checksums that differ only in
+// case. The scan keeps whichever spelling it visits and prunes the rest.
+func (s *Scanner) warnCaseCollisions(outputPath string, checksums map[string]Record) {
+	folded := make(map[string][]string)
+	for key := range checksums {
+		fold := strings.ToLower(key)
+		folded[fold] = append(folded[fold], key)
+	}
+	for _, keys := range folded {
+		if len(keys) > 1 {
+			sort.Strings(keys)
+			s.errorf("WARNING: %s lists %s, which differ only in case", outputPath, strings.Join(keys, ", "))
+		}
+	}
+}
+
+// missingFiles returns the keys of the relative paths from files that do
+// not exist below r.
+func missingFiles(r root, files []string) []string {
+	var gone []string
+	for _, name := range files {
+		relPath := filepath.Clean(filepath.FromSlash(name))
+		if _, err := os.Lstat(filepath.Join(r.dir, relPath)); os.IsNotExist(err) {
+			gone = append(gone, r.key(relPath))
+		}
+	}
+	return gone
+}
+
+// realPath returns path with symlinks resolved, or path itself if it
+// cannot be resolved.
+func realPath(path string) string {
+	if real, err := filepath.EvalSymlinks(path); err == nil {
+		return real
+	}
+	return path
+}
+
+// isStale reports whether a file needs rehashing. Records that carry a size
+// and modtime are stale as soon as either, or the recorded mode, differs
+// from the file on disk; records without them fall back to comparing
+// against the last run time.
+func isStale(rec Record, info os.FileInfo, lastRun time.Time) bool {
+	if !rec.ModTime.IsZero() {
+		return rec.Size != info.Size() || !rec.ModTime.Equal(info.ModTime()) ||
+			(rec.Mode != "" && rec.Mode != permBits(info))
+	}
+	return info.ModTime().After(lastRun)
+}
+
+// stale reports whether a file with an entry needs rehashing, using Since
+// in place of the stored metadata and last run time when it is set.
+func (s *Scanner) stale(rec Record, info os.FileInfo, lastRun time.Time) bool {
+	if !s.Since.IsZero() {
+		return info.ModTime().After(s.Since) || (!rec.ModTime.IsZero() && rec.Size != info.Size())
+	}
+	return isStale(rec, info, lastRun)
+}
+
+// renamedFrom returns the entry in checksums whose device and inode, found
+// through byInode, size and modtime match the file at key, which has no
+// entry of its own, or nil if there is none.
+func (s *Scanner) renamedFrom(key string, info os.FileInfo, byInode map[linkID]string, checksums map[string]Record) *Record {
+	id, ok := fileID(info)
+	if !ok {
+		return nil
+	}
+	from, ok := byInode[id]
+	if !ok {
+		return nil
+	}
+	rec := checksums[from]
+	if rec.Size != info.Size() || !rec.ModTime.Equal(info.ModTime()) || s.due(rec) {
+		return nil
+	}
+	s.tracef("%s has the inode of %s, reusing its checksum", key, from)
+	return &rec
+}
+
+// sizeAllowed reports whether the size of the file described by info is
+// within MinFileSize and MaxFileSize.
+func (s *Scanner) sizeAllowed(info os.FileInfo) bool {
+	return (s.MaxFileSize <= 0 || info.Size() <= s.MaxFileSize) && (s.MinFileSize <= 0 || info.Size() >= s.MinFileSize)
+}
+
+// tooYoung reports whether the file described by info was modified less
+// than MinAge ago.
+func (s *Scanner) tooYoung(info os.FileInfo) bool {
+	return s.MinAge > 0 && time.Since(info.ModTime()) < s.MinAge
+}
+
+// sizeOnlyChange reports whether the file's size differs from the one rec
+// recorded while its modtime does not.
+func sizeOnlyChange(rec Record, info os.FileInfo) bool {
+	return !rec.ModTime.IsZero() && rec.Size != info.Size() && rec.ModTime.Equal(info.ModTime())
+}
+
+// warnSizeOnly warns about a file whose size changed behind a preserved
+// modtime.
+func (s *Scanner) warnSizeOnly(key string, rec Record, info os.FileInfo) {
+	s.errorf("WARNING: %s changed size from %d to %d bytes but kept its modtime; something may be preserving modtimes while altering content",
+		key, rec.Size, info.Size())
+}
+
+// due reports whether rec was hashed longer than RehashOlderThan ago.
+// Entries without a hash time are always due.
+func (s *Scanner) due(rec Record) bool {
+	return s.RehashOlderThan > 0 && time.Since(rec.HashedAt) > s.RehashOlderThan
+}
+
+// acquireLock creates the lock file at path, failing if it already exists,
+// and returns a function that removes it. The lock records the holder's
+// PID so a stale lock left by a crashed run can be identified.
+func acquireLock(path string) (func(), error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if os.IsExist(err) {
+		holder, _ := os.ReadFile(path)
+		return nil, fmt.Errorf("another run holds %s (pid %s); remove it if that run is no longer active",
+			path, strings.TrimSpace(string(holder)))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to create lock file: %w", err)
+	}
+	fmt.Fprintf(file, "%d\n", os.Getpid())
+	file.Close()
+	return func() { os.Remove(path) }, nil
+}
+
+func getLastRunTime(path string) time.Time {
+	info, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
+
+// updateLastRuns advances the timestamp file of every root, reporting
+// each through logf. A file shared by several roots is touched once.
+func updateLastRuns(roots []root, logf func(format string, args ...any)) error {
+	done := make(map[string]bool)
+	for _, r := range roots {
+		if done[r.timestamp] {
+			continue
+		}
+		done[r.timestamp] = true
+		logf("Updated last run: %s", r.timestamp)
+		if err := updateLastRun(r.timestamp); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func updateLastRun(path string) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	file.Close()
+	now := time.Now()
+	return os.Chtimes(path, now, now)
+}
+
+// HashReader returns the digest of everything read from r with the
+// scanner's algorithm. No checksum or timestamp file is involved.
+func (s *Scanner) HashReader(r io.Reader) (string, error) {
+	newHash, err := newHashFor(s.algorithm(""))
+	if err != nil {
+		return "", err
+	}
+	return ReaderHash(r, make([]byte, s.bufferSize()), newHash())
+}
+
+// newHashFor returns the constructor for algo, which may join several
+// algorithms with AlgorithmSeparator.
+func newHashFor(algo string) (func() hash.Hash, error) {
+	if algo == MetadataAlgorithm {
+		return md5.New, nil
+	}
+	if names := strings.Split(algo, AlgorithmSeparator); len(names) > 1 {
+		news := make([]func() hash.Hash, len(names))
+		for i, name := range names {
+			newHash, ok := HashAlgorithms[name]
+			if !ok || slices.Contains(names[:i], name) {
+				return nil, fmt.Errorf("unsupported algorithm: %s", algo)
+			}
+			news[i] = newHash
+		}
+		return func() hash.Hash {
+			m := make(multiHash, len(news))
+			for i, newHash := range news {
+				m[i] = newHash()
+			}
+			return m
+		}, nil
+	}
+	newHash, ok := HashAlgorithms[algo]
+	if !ok {
+		return nil, fmt.Errorf("unsupported algorithm: %s", algo)
+	}
+	return newHash, nil
+}
@@ -0,0 +1,220 @@
+package incmd5
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// keys returns the keys of checksums, sorted.
+func keys(checksums map[string]Record) []string {
+	keys := make([]string, 0, len(checksums))
+	for key := range checksums {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+func TestScanSkipsOwnFilesByPath(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"file.txt":                "x",
+		"sub/" + MD5TimestampFile: "a user file sharing the marker's name",
+		"sub/" + MD5LockFile:      "and the lock's",
+	})
+	s := &Scanner{Output: filepath.Join(dir, "md5sums.txt")}
+	// The second run finds the marker and lock files of the first.
+	for run := 1; run <= 2; run++ {
+		res, err := s.Scan(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := []string{"file.txt", "sub/" + MD5LockFile, "sub/" + MD5TimestampFile}
+		if got := keys(res.Checksums); !slices.Equal(got, want) {
+			t.Errorf("run %d: recorded %q, want %q", run, got, want)
+		}
+	}
+}
+
+func TestScanOutputInsideDir(t *testing.T) {
+	for _, format := range []string{FormatText, FormatJSON} {
+		dir := t.TempDir()
+		writeFiles(t, dir, map[string]string{"file.txt": "x", "sub/other.txt": "y"})
+		output := filepath.Join(dir, "sums."+format)
+		// A followed symlink reaches the checksum file by another path.
+		if err := os.Symlink(output, filepath.Join(dir, "sub", "alias")); err != nil {
+			t.Logf("no symlink to the checksum file: %v", err)
+		}
+		s := &Scanner{Output: output, Format: format, FollowSymlinks: true}
+		if _, err := s.Scan(dir); err != nil {
+			t.Fatal(err)
+		}
+		res, err := s.Scan(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.Changed || res.Written || len(res.Added)+len(res.Modified)+len(res.Removed) > 0 {
+			t.Errorf("%s: second run changed %+v", format, res)
+		}
+		if got, want := keys(res.Checksums), []string{"file.txt", "sub/other.txt"}; !slices.Equal(got, want) {
+			t.Errorf("%s: recorded %q, want %q", format, got, want)
+		}
+	}
+}
+
+func TestCaseInsensitiveCollisions(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{"Foo.txt": "upper", "foo.txt": "lower", "Sub/File.txt": "x"})
+	if data, _ := os.ReadFile(filepath.Join(dir, "Foo.txt")); string(data) != "upper" {
+		t.Skip("the file system is case-insensitive")
+	}
+	output := filepath.Join(dir, "md5sums.txt")
+	res, err := (&Scanner{Output: output}).Scan(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := keys(res.Checksums), []string{"Foo.txt", "Sub/File.txt", "foo.txt"}; !slices.Equal(got, want) {
+		t.Errorf("case-sensitive scan recorded %q, want %q", got, want)
+	}
+
+	// The checksum file now lists two keys that differ only in case,
+	// which a case-insensitive scan warns about before keeping the first
+	// spelling it walks.
+	var logs strings.Builder
+	s := &Scanner{Output: output, CaseInsensitive: true, Logger: log.New(&logs, "", 0)}
+	res, err = s.Scan(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := keys(res.Checksums), []string{"Foo.txt", "Sub/File.txt"}; !slices.Equal(got, want) {
+		t.Errorf("case-insensitive scan recorded %q, want %q", got, want)
+	}
+	if !strings.Contains(logs.String(), "Foo.txt, foo.txt, which differ only in case") {
+		t.Errorf("no warning about the entries differing in case:\n%s", logs.String())
+	}
+	if !strings.Contains(logs.String(), "Foo.txt and foo.txt differ only in case") {
+		t.Errorf("no warning about the files differing in case:\n%s", logs.String())
+	}
+
+	// A listed file takes the spelling found on disk.
+	s.Files = []string{"sub/FILE.TXT"}
+	res, err = s.Scan(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := res.Checksums["Sub/File.txt"]; !ok || len(res.Added) > 0 {
+		t.Errorf("listed file recorded as %q, want the existing Sub/File.txt", res.Added)
+	}
+}
+
+func TestScanSingleFile(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{"file.txt": "hello\n", "other.txt": "x"})
+	output := filepath.Join(dir, "md5sums.txt")
+	if err := WriteChecksums(output, map[string]Record{"kept.txt": {Hash: "d41d8cd98f00b204e9800998ecf8427e"}}, Header{Algorithm: "md5"}, FormatText); err != nil {
+		t.Fatal(err)
+	}
+	s := &Scanner{Output: output}
+	res, err := s.Scan(filepath.Join(dir, "file.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(res.Added, []string{"file.txt"}) {
+		t.Errorf("added %q, want only file.txt", res.Added)
+	}
+	if got := res.Checksums["file.txt"].Hash; got != "b1946ac92492d2347c6235b4d2611184" {
+		t.Errorf("file.txt recorded as %q", got)
+	}
+	if _, ok := res.Checksums["kept.txt"]; !ok {
+		t.Error("the other entries of the checksum file were dropped")
+	}
+	if _, ok := res.Checksums["other.txt"]; ok {
+		t.Error("a file next to the one given was hashed too")
+	}
+}
+
+func TestDeleteEmpty(t *testing.T) {
+	for _, deleteEmpty := range []bool{false, true} {
+		dir := t.TempDir()
+		writeFiles(t, dir, map[string]string{"a.txt": "a", "sub/b.txt": "b"})
+		output := filepath.Join(t.TempDir(), "md5sums.txt")
+		s := &Scanner{Output: output, DeleteEmpty: deleteEmpty}
+		if _, err := s.Scan(dir); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Remove(filepath.Join(dir, "a.txt")); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.RemoveAll(filepath.Join(dir, "sub")); err != nil {
+			t.Fatal(err)
+		}
+		res, err := s.Scan(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(res.Removed) != 2 || res.Entries != 0 {
+			t.Errorf("deleteEmpty=%v: removed %q leaving %d entries", deleteEmpty, res.Removed, res.Entries)
+		}
+		_, err = os.Stat(output)
+		if deleteEmpty && (!res.Deleted || !os.IsNotExist(err)) {
+			t.Errorf("checksum file not deleted: Deleted=%v, %v", res.Deleted, err)
+		}
+		if !deleteEmpty && (res.Deleted || err != nil) {
+			t.Errorf("empty checksum file not kept: Deleted=%v, %v", res.Deleted, err)
+		}
+	}
+
+	// An existing file without entries is deleted even though nothing
+	// changed.
+	dir := t.TempDir()
+	output := filepath.Join(t.TempDir(), "md5sums.txt")
+	if err := os.WriteFile(output, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	res, err := (&Scanner{Output: output, DeleteEmpty: true}).Scan(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(output); !res.Deleted || !os.IsNotExist(err) {
+		t.Errorf("unchanged empty checksum file not deleted: Deleted=%v, %v", res.Deleted, err)
+	}
+}
+
+func TestHardLinksHashedOnce(t *testing.T) {
+	defer func() { testHookHashed = nil }()
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{"a.txt": "shared content\n"})
+	if err := os.Link(filepath.Join(dir, "a.txt"), filepath.Join(dir, "b.txt")); err != nil {
+		t.Skipf("cannot create a hard link: %v", err)
+	}
+	if info, err := os.Stat(filepath.Join(dir, "a.txt")); err != nil {
+		t.Fatal(err)
+	} else if _, ok := fileLink(info); !ok {
+		t.Skip("hard links are not detected on this platform")
+	}
+	var mu sync.Mutex
+	var hashed []string
+	testHookHashed = func(path string) {
+		mu.Lock()
+		defer mu.Unlock()
+		hashed = append(hashed, filepath.Base(path))
+	}
+	res, err := (&Scanner{Output: filepath.Join(t.TempDir(), "md5sums.txt")}).Scan(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(hashed, []string{"a.txt"}) {
+		t.Errorf("read %q, want only a.txt", hashed)
+	}
+	if want := []HardLink{{Path: "b.txt", LinkOf: "a.txt"}}; !slices.Equal(res.HardLinks, want) {
+		t.Errorf("HardLinks = %v, want %v", res.HardLinks, want)
+	}
+	if a, b := res.Checksums["a.txt"].Hash, res.Checksums["b.txt"].Hash; a == "" || a != b {
+		t.Errorf("links recorded as %q and %q", a, b)
+	}
+}
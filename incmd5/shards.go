@@ -0,0 +1,165 @@
+package incmd5
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// ShardSuffix ends the name of a sharded checksum file: a directory that
+// holds a checksum file for each top-level directory of the tree, and one
+// for the files directly in it, so that a change rewrites only the shard
+// it falls in and diffs stay local to it. Every shard lists full keys, and
+// reading the directory merges them.
+const ShardSuffix = ".d"
+
+// rootShard names the shard holding the files directly in the root.
+const rootShard = "_root"
+
+// IsSharded reports whether the checksum file at path is a directory of
+// shards, by its name.
+func IsSharded(path string) bool {
+	return path != StdoutPath && strings.HasSuffix(path, ShardSuffix)
+}
+
+// shardOf returns the name of the shard, without extension, that holds
+// key: its first path element, or rootShard for a file in the root. An
+// archive member goes with its archive.
+func shardOf(key string) string {
+	if archive := archiveOf(key); archive != "" {
+		key = archive
+	}
+	first, _, ok := strings.Cut(key, "/")
+	if !ok {
+		return rootShard
+	}
+	return first
+}
+
+// shardExt is the extension of the shards of a file in format, which
+// ReadChecksums judges them by.
+func shardExt(format string) string {
+	switch format {
+	case FormatJSON:
+		return ".json"
+	case FormatSFV:
+		return ".sfv"
+	}
+	return ".txt"
+}
+
+// shardExts are the extensions a shard may have, each possibly followed
+// by .gz.
+var shardExts = []string{".txt", ".json", ".sfv", ".bsd"}
+
+// isShard reports whether name has the extension of a shard.
+func isShard(name string) bool {
+	return slices.Contains(shardExts, strings.ToLower(dataExt(name)))
+}
+
+// shardFiles returns the paths of the shards in dir, sorted. Other files,
+// such as a README or a shard's temporary file, are left out. A missing
+// dir has none.
+func shardFiles(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, e := range entries {
+		if e.Type().IsRegular() && isShard(e.Name()) {
+			files = append(files, filepath.Join(dir, e.Name()))
+		}
+	}
+	return files, nil
+}
+
+// readShards is ReadChecksums for the shards in dir. A key listed in more
+// than one shard is kept once if they agree and is a *CorruptError if
+// they do not, as are shards holding different algorithms. The header is
+// that of the first shard.
+func readShards(dir string) (map[string]Record, Header, error) {
+	checksums := make(map[string]Record)
+	header := Header{Algorithm: DefaultAlgorithm}
+	files, err := shardFiles(dir)
+	if err != nil {
+		return checksums, header, &CorruptError{Path: dir, Err: err}
+	}
+	// from maps each key to the shard it was first read from.
+	from := make(map[string]string)
+	var firstErr error
+	for i, file := range files {
+		shard, shardHeader, err := ReadChecksums(file)
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+		if i == 0 {
+			header = shardHeader
+		} else if len(shard) > 0 && shardHeader.Algorithm != header.Algorithm && firstErr == nil {
+			firstErr = &CorruptError{Path: dir, Err: fmt.Errorf("%s holds %s checksums, %s holds %s", filepath.Base(files[0]), header.Algorithm, filepath.Base(file), shardHeader.Algorithm)}
+		}
+		for key, rec := range shard {
+			if other, ok := checksums[key]; ok {
+				if other.Hash != rec.Hash && firstErr == nil {
+					firstErr = &CorruptError{Path: dir, Err: fmt.Errorf("%s is listed as %s in %s and as %s in %s", key, other.Hash, from[key], rec.Hash, filepath.Base(file))}
+				}
+				continue
+			}
+			checksums[key] = rec
+			from[key] = filepath.Base(file)
+		}
+	}
+	return checksums, header, firstErr
+}
+
+// writeShards is writeChecksums for the directory of shards at dir. Each
+// shard is replaced atomically, and shards left without entries are
+// removed, but a reader may see some shards before and others after the
+// write. Shards in another format, left by an earlier write, are removed
+// too, while files that are not shards, such as a README, are kept.
+func writeShards(dir string, checksums map[string]Record, header Header, format string, order []string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	shards := make(map[string]map[string]Record)
+	for key, rec := range checksums {
+		name := shardOf(key) + shardExt(format)
+		if shards[name] == nil {
+			shards[name] = make(map[string]Record)
+		}
+		shards[name][key] = rec
+	}
+	names := make([]string, 0, len(shards))
+	for name := range shards {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		shard := shards[name]
+		paths := orderedPaths(shard, order)
+		if err := writeAtomic(filepath.Join(dir, name), func(w io.Writer) error {
+			return encodeChecksums(w, shard, paths, header, format)
+		}); err != nil {
+			return err
+		}
+	}
+	files, err := shardFiles(dir)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if shards[filepath.Base(file)] == nil {
+			if err := os.Remove(file); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,97 @@
+package incmd5
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestShardsSkipOtherFiles(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{"a.txt": "a", "b/c.txt": "c"})
+	output := filepath.Join(t.TempDir(), "sums"+ShardSuffix)
+	s := &Scanner{Output: output}
+	if _, err := s.Scan(dir); err != nil {
+		t.Fatal(err)
+	}
+	readme := filepath.Join(output, "README")
+	if err := os.WriteFile(readme, []byte("One checksum file per top-level directory.\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	writeFiles(t, dir, map[string]string{"b/d.txt": "d"})
+	res, err := s.Scan(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"b/d.txt"}; !slices.Equal(res.Added, want) {
+		t.Errorf("added %q, want %q", res.Added, want)
+	}
+	checksums, _, err := ReadChecksums(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := keys(checksums), []string{"a.txt", "b/c.txt", "b/d.txt"}; !slices.Equal(got, want) {
+		t.Errorf("read %q, want %q", got, want)
+	}
+	if _, err := os.Stat(readme); err != nil {
+		t.Errorf("README: %v", err)
+	}
+}
+
+func TestShardsFormatChange(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{"a.txt": "a", "b/f.txt": "f", "b/g.txt": "g"})
+	output := filepath.Join(t.TempDir(), "sums"+ShardSuffix)
+	if _, err := (&Scanner{Output: output}).Scan(dir); err != nil {
+		t.Fatal(err)
+	}
+	s := &Scanner{Output: output, Format: FormatJSON}
+	if _, err := s.Scan(dir); err != nil {
+		t.Fatal(err)
+	}
+	files, err := shardFiles(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{filepath.Join(output, rootShard+".json"), filepath.Join(output, "b.json")}
+	if !slices.Equal(files, want) {
+		t.Errorf("shards %q, want %q", files, want)
+	}
+
+	if err := os.Remove(filepath.Join(dir, "b", "g.txt")); err != nil {
+		t.Fatal(err)
+	}
+	res, err := s.Scan(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"b/g.txt"}; !slices.Equal(res.Removed, want) {
+		t.Errorf("removed %q, want %q", res.Removed, want)
+	}
+	res, err = s.Scan(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Removed) > 0 || res.Written {
+		t.Errorf("pruned entries came back: removed %q, written %v", res.Removed, res.Written)
+	}
+}
+
+func TestShardsListedInsideDir(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{"a.txt": "a", "b/c.txt": "c"})
+	output := filepath.Join(dir, "sums"+ShardSuffix)
+	if _, err := (&Scanner{Output: output}).Scan(dir); err != nil {
+		t.Fatal(err)
+	}
+	s := &Scanner{Output: output, Files: []string{"a.txt", "sums.d/_root.txt", filepath.Join(output, "b.txt")}}
+	res, err := s.Scan(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := keys(res.Checksums), []string{"a.txt", "b/c.txt"}; !slices.Equal(got, want) {
+		t.Errorf("recorded %q, want %q", got, want)
+	}
+}
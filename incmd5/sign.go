@@ -0,0 +1,97 @@
+package incmd5
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"os"
+)
+
+// SignatureSuffix is appended to the name of a checksum file to name its
+// detached signature, which holds the base64 Ed25519 signature of the
+// file's bytes as written, compressed or not.
+const SignatureSuffix = ".sig"
+
+// ReadSigningKey reads an Ed25519 private key from the PEM file at path,
+// in the PKCS #8 form written by openssl genpkey -algorithm ed25519.
+func ReadSigningKey(path string) (ed25519.PrivateKey, error) {
+	block, err := readPEM(path)
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	private, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s does not hold an Ed25519 private key", path)
+	}
+	return private, nil
+}
+
+// ReadVerifyingKey reads an Ed25519 public key from the PEM file at path,
+// in the PKIX form written by openssl pkey -pubout.
+func ReadVerifyingKey(path string) (ed25519.PublicKey, error) {
+	block, err := readPEM(path)
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	public, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("%s does not hold an Ed25519 public key", path)
+	}
+	return public, nil
+}
+
+func readPEM(path string) (*pem.Block, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s is not a PEM file", path)
+	}
+	return block, nil
+}
+
+// SignFile writes the detached signature of the file at path with key to
+// path+SignatureSuffix, replacing it atomically.
+func SignFile(path string, key ed25519.PrivateKey) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	sig := base64.StdEncoding.EncodeToString(ed25519.Sign(key, data)) + "\n"
+	return writeAtomic(path+SignatureSuffix, func(w io.Writer) error {
+		_, err := io.WriteString(w, sig)
+		return err
+	})
+}
+
+// VerifyFile checks the detached signature of the file at path against
+// key, returning an error if it is missing or does not match.
+func VerifyFile(path string, key ed25519.PublicKey) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	encoded, err := os.ReadFile(path + SignatureSuffix)
+	if err != nil {
+		return fmt.Errorf("cannot read the signature of %s: %w", path, err)
+	}
+	sig, err := base64.StdEncoding.DecodeString(string(bytes.TrimSpace(encoded)))
+	if err != nil || !ed25519.Verify(key, data, sig) {
+		return fmt.Errorf("%s does not match its signature %s", path, path+SignatureSuffix)
+	}
+	return nil
+}
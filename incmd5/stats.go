@@ -0,0 +1,74 @@
+package incmd5
+
+import (
+	"math"
+	"sort"
+	"time"
+)
+
+// statsSlowest is how many of the slowest files HashStats lists.
+const statsSlowest = 10
+
+// FileTiming is the time one file took to hash.
+type FileTiming struct {
+	Path     string        `json:"path"`
+	Bytes    int64         `json:"bytes"`
+	Duration time.Duration `json:"duration_ns"`
+}
+
+// HashStats summarizes how long the files of a scan took to hash,
+// including retries and archive members. Throughput percentiles are taken
+// over the non-empty files, in bytes per second.
+type HashStats struct {
+	Files         int           `json:"files"`
+	P50           time.Duration `json:"p50_ns"`
+	P95           time.Duration `json:"p95_ns"`
+	P99           time.Duration `json:"p99_ns"`
+	Max           time.Duration `json:"max_ns"`
+	ThroughputP10 float64       `json:"throughput_p10"`
+	ThroughputP50 float64       `json:"throughput_p50"`
+	ThroughputP90 float64       `json:"throughput_p90"`
+	// Slowest lists the files that took longest, slowest first.
+	Slowest []FileTiming `json:"slowest"`
+}
+
+// newHashStats summarizes timings, or returns nil if there are none. It
+// sorts timings.
+func newHashStats(timings []FileTiming) *HashStats {
+	if len(timings) == 0 {
+		return nil
+	}
+	sort.Slice(timings, func(i, j int) bool { return timings[i].Duration > timings[j].Duration })
+	latency := func(p float64) time.Duration {
+		return timings[len(timings)-1-percentileIndex(len(timings), p)].Duration
+	}
+	stats := &HashStats{
+		Files:   len(timings),
+		P50:     latency(50),
+		P95:     latency(95),
+		P99:     latency(99),
+		Max:     timings[0].Duration,
+		Slowest: timings[:min(statsSlowest, len(timings))],
+	}
+
+	var rates []float64
+	for _, t := range timings {
+		if t.Bytes > 0 && t.Duration > 0 {
+			rates = append(rates, float64(t.Bytes)/t.Duration.Seconds())
+		}
+	}
+	if len(rates) > 0 {
+		sort.Float64s(rates)
+		stats.ThroughputP10 = rates[percentileIndex(len(rates), 10)]
+		stats.ThroughputP50 = rates[percentileIndex(len(rates), 50)]
+		stats.ThroughputP90 = rates[percentileIndex(len(rates), 90)]
+	}
+	return stats
+}
+
+// percentileIndex returns the index of the p-th percentile in n ascending
+// values, by the nearest-rank method.
+func percentileIndex(n int, p float64) int {
+	i := int(math.Ceil(p/100*float64(n))) - 1
+	return max(0, min(i, n-1))
+}
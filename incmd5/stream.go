@@ -0,0 +1,215 @@
+package incmd5
+
+import (
+	"bufio"
+	"container/heap"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// streamChunk is the number of entries a streamed scan holds in memory
+// before spilling them, sorted, to a temporary file.
+const streamChunk = 1 << 16
+
+// entryStream collects the entries of a Stream scan in whatever order
+// they are decided and writes them sorted, merging the runs it spilled to
+// disk. Only the keys are kept in memory, to tell which entries were
+// already added. It is safe for concurrent use.
+type entryStream struct {
+	mu      sync.Mutex
+	dir     string
+	pending []streamEntry
+	runs    []string
+	done    map[string]bool
+	n       int
+	err     error
+}
+
+type streamEntry struct{ key, hash string }
+
+// newEntryStream returns an entryStream spilling to a new temporary
+// directory, which close removes.
+func newEntryStream() (*entryStream, error) {
+	dir, err := os.MkdirTemp("", "incmd5-stream-")
+	if err != nil {
+		return nil, err
+	}
+	return &entryStream{dir: dir, done: make(map[string]bool)}, nil
+}
+
+// add appends the entry for key unless key was already added or dropped,
+// such as a member listed twice in its archive. The first error spilling
+// is kept for write to return.
+func (es *entryStream) add(key, hash string) {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+	if es.done[key] {
+		return
+	}
+	es.done[key] = true
+	es.n++
+	es.pending = append(es.pending, streamEntry{key, hash})
+	if len(es.pending) >= streamChunk && es.err == nil {
+		es.err = es.spill()
+	}
+}
+
+// drop marks key as decided without adding an entry for it.
+func (es *entryStream) drop(key string) {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+	es.done[key] = true
+}
+
+// added reports whether key was added or dropped.
+func (es *entryStream) added(key string) bool {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+	return es.done[key]
+}
+
+// len returns the number of entries added.
+func (es *entryStream) len() int {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+	return es.n
+}
+
+// spill writes the pending entries, sorted, to a new run file as
+// NUL-terminated key and hash pairs, which no path can contain.
+func (es *entryStream) spill() (err error) {
+	sortEntries(es.pending)
+	file, err := os.Create(filepath.Join(es.dir, "run"+strconv.Itoa(len(es.runs))))
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cerr := file.Close(); err == nil {
+			err = cerr
+		}
+	}()
+	w := bufio.NewWriter(file)
+	for _, e := range es.pending {
+		w.WriteString(e.key)
+		w.WriteByte(0)
+		w.WriteString(e.hash)
+		w.WriteByte(0)
+	}
+	es.runs = append(es.runs, file.Name())
+	es.pending = es.pending[:0]
+	return w.Flush()
+}
+
+// write replaces path with every entry added, sorted by key, in format,
+// merging the spilled runs with those still pending.
+func (es *entryStream) write(path string, header Header, format string) error {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+	if es.err != nil {
+		return es.err
+	}
+	sortEntries(es.pending)
+	var cursors []*streamCursor
+	for _, run := range es.runs {
+		file, err := os.Open(run)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		cursors = append(cursors, &streamCursor{r: bufio.NewReader(file)})
+	}
+	cursors = append(cursors, &streamCursor{entries: es.pending})
+
+	return writeAtomic(path, func(w io.Writer) error {
+		bw := bufio.NewWriter(w)
+		if err := writeLineHeader(bw, header, format); err != nil {
+			return err
+		}
+		var h cursorHeap
+		for _, c := range cursors {
+			ok, err := c.next()
+			if err != nil {
+				return err
+			}
+			if ok {
+				h = append(h, c)
+			}
+		}
+		heap.Init(&h)
+		for len(h) > 0 {
+			c := h[0]
+			if err := writeLine(bw, c.cur.key, c.cur.hash, header, format); err != nil {
+				return err
+			}
+			ok, err := c.next()
+			if err != nil {
+				return err
+			}
+			if ok {
+				heap.Fix(&h, 0)
+			} else {
+				heap.Pop(&h)
+			}
+		}
+		return bw.Flush()
+	})
+}
+
+// close removes the spilled runs.
+func (es *entryStream) close() {
+	os.RemoveAll(es.dir)
+}
+
+func sortEntries(entries []streamEntry) {
+	sort.Slice(entries, func(i, j int) bool { return entries[i].key < entries[j].key })
+}
+
+// streamCursor reads the sorted entries of one run file, or of the pending
+// entries if r is nil.
+type streamCursor struct {
+	r       *bufio.Reader
+	entries []streamEntry
+	cur     streamEntry
+}
+
+// next advances to the following entry, reporting false at the end.
+func (c *streamCursor) next() (bool, error) {
+	if c.r == nil {
+		if len(c.entries) == 0 {
+			return false, nil
+		}
+		c.cur, c.entries = c.entries[0], c.entries[1:]
+		return true, nil
+	}
+	key, err := c.r.ReadString(0)
+	if err == io.EOF && key == "" {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	hash, err := c.r.ReadString(0)
+	if err != nil {
+		return false, err
+	}
+	c.cur = streamEntry{key[:len(key)-1], hash[:len(hash)-1]}
+	return true, nil
+}
+
+// cursorHeap orders cursors by their current key.
+type cursorHeap []*streamCursor
+
+func (h cursorHeap) Len() int           { return len(h) }
+func (h cursorHeap) Less(i, j int) bool { return h[i].cur.key < h[j].cur.key }
+func (h cursorHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *cursorHeap) Push(x any)        { *h = append(*h, x.(*streamCursor)) }
+func (h *cursorHeap) Pop() any {
+	old := *h
+	c := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return c
+}
@@ -0,0 +1,8 @@
+//go:build !unix
+
+package incmd5
+
+// syncDir is a no-op where directories cannot be synced.
+func syncDir(dir string) error {
+	return nil
+}
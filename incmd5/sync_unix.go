@@ -0,0 +1,15 @@
+//go:build unix
+
+package incmd5
+
+import "os"
+
+// syncDir flushes the directory entry for a file renamed into dir.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
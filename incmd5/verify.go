@@ -0,0 +1,428 @@
+package incmd5
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// VerifyResult lists the discrepancies found by Verify. Every slice is
+// sorted.
+type VerifyResult struct {
+	// Entries is the number of entries in the checksum file.
+	Entries int
+	// Resumed is the number of entries skipped because VerifyCheckpoint
+	// shows an earlier run confirmed them.
+	Resumed int
+	// Mismatched lists files whose digest differs from the stored one.
+	Mismatched []string
+	// Missing lists entries whose file no longer exists.
+	Missing []string
+	// Failed lists entries whose file could not be hashed.
+	Failed []string
+	// ModeChanged lists files whose content matches but whose permission
+	// bits differ from the recorded mode.
+	ModeChanged []string
+	// Unlisted lists files on disk that have no entry.
+	Unlisted []string
+	// Sampled lists the entries checked with Scanner.VerifySample, not
+	// counting archive members, and Seed is the seed they were picked
+	// with.
+	Sampled []string
+	Seed    int64
+	// Touched is the number of entries whose HashedAt was advanced, with
+	// Scanner.TouchUnchanged.
+	Touched int
+	// Duration is the time spent verifying.
+	Duration time.Duration
+}
+
+// OK reports whether every listed file exists and matches, including its
+// recorded mode. Unlisted files do not count as failures.
+func (r VerifyResult) OK() bool {
+	return len(r.Mismatched) == 0 && len(r.Missing) == 0 && len(r.Failed) == 0 && len(r.ModeChanged) == 0
+}
+
+// Reconciled reports whether the checksum file and the tree agree in both
+// directions: every entry matches, as for OK, and no file on disk is
+// unlisted.
+func (r VerifyResult) Reconciled() bool {
+	return r.OK() && len(r.Unlisted) == 0
+}
+
+// Verify checks dir against the checksum file. It is VerifyContext with a
+// background context.
+func (s *Scanner) Verify(dir string) (VerifyResult, error) {
+	return s.VerifyContext(context.Background(), dir)
+}
+
+// VerifyContext checks dir against the checksum file. It is
+// VerifyDirsContext with a single directory.
+func (s *Scanner) VerifyContext(ctx context.Context, dir string) (VerifyResult, error) {
+	return s.VerifyDirsContext(ctx, []string{dir})
+}
+
+// VerifyDirsContext rehashes every file listed in the checksum file, or in
+// Reference if it is set, using the algorithm and symlink handling the
+// file was written with, and reports mismatches, missing files, and files
+// on disk that are not listed. dirs must be the directories the file was
+// produced from; keys that belong to none of them are reported as
+// missing. Archive members listed along with their archive are checked by
+// reading the archive, whether or not Archives is set. The timestamp file
+// is not modified, and neither is the checksum file unless TouchUnchanged
+// is set. If ctx is cancelled the partial result is returned together with
+// ctx.Err().
+func (s *Scanner) VerifyDirsContext(ctx context.Context, dirs []string) (VerifyResult, error) {
+	if err := s.validate(); err != nil {
+		return VerifyResult{}, err
+	}
+	roots, outputPath, err := s.resolve(dirs)
+	if err != nil {
+		return VerifyResult{}, err
+	}
+	if outputPath == StdoutPath && s.Database == "" && s.Reference == "" {
+		return VerifyResult{}, errors.New("cannot verify against standard output")
+	}
+	if s.VerifyKey != nil && (s.Database != "" || s.PerDir) {
+		return VerifyResult{}, errors.New("checking a signature needs a single checksum file, not per-directory files or a database")
+	}
+	if s.VerifyCheckpoint != "" && (s.Database != "" || s.PerDir) {
+		return VerifyResult{}, errors.New("a verify checkpoint needs a single checksum file, not per-directory files or a database")
+	}
+	if s.Reference != "" && (s.Database != "" || s.PerDir) {
+		return VerifyResult{}, errors.New("a reference needs a single checksum file, not per-directory files or a database")
+	}
+	if IsURL(s.Reference) && (s.VerifyKey != nil || s.VerifyCheckpoint != "" || s.TouchUnchanged) {
+		return VerifyResult{}, errors.New("checking a signature, keeping a verify checkpoint or touching entries needs a local checksum file, not a URL")
+	}
+	if s.TouchUnchanged && (s.Database != "" || s.PerDir) {
+		return VerifyResult{}, errors.New("touching entries needs a single checksum file, not per-directory files or a database")
+	}
+	if s.TouchUnchanged && s.VerifyKey != nil && s.SignKey == nil {
+		return VerifyResult{}, errors.New("touching entries would invalidate the signature checked with the verify key; give a signing key too")
+	}
+	// refPath is the local checksum file the entries are read from.
+	refPath := outputPath
+	if s.Reference != "" && !IsURL(s.Reference) {
+		if refPath, err = filepath.Abs(s.Reference); err != nil {
+			return VerifyResult{}, err
+		}
+	}
+	var checksums map[string]Record
+	var header Header
+	if s.Database != "" {
+		outputPath, err = filepath.Abs(s.Database)
+		if err != nil {
+			return VerifyResult{}, err
+		}
+		checksums, header, err = ReadDatabase(outputPath)
+		if err != nil {
+			return VerifyResult{}, err
+		}
+	} else if s.PerDir {
+		if len(roots) != 1 {
+			return VerifyResult{}, errors.New("per-directory checksum files require a single directory")
+		}
+		checksums, header, _, err = s.readPerDir(ctx, roots[0], filepath.Base(outputPath), "")
+		if err != nil {
+			return VerifyResult{}, err
+		}
+	} else {
+		if s.VerifyKey != nil {
+			if err := VerifyFile(refPath, s.VerifyKey); err != nil {
+				return VerifyResult{}, err
+			}
+			s.logf("%s matches its signature", refPath)
+		}
+		if IsURL(s.Reference) {
+			checksums, header, err = s.readReference(ctx)
+		} else {
+			checksums, header, err = ReadChecksums(refPath)
+		}
+		if err != nil {
+			if !s.AllowCorrupt {
+				return VerifyResult{}, err
+			}
+			s.errorf("WARNING: %v; verifying the %d entries that could be read", err, len(checksums))
+		}
+	}
+	newHash, err := newHashFor(header.Algorithm)
+	if err != nil {
+		return VerifyResult{}, err
+	}
+	if s.TouchUnchanged {
+		if format := DetectFormat(refPath); format != FormatJSON {
+			return VerifyResult{}, fmt.Errorf("touching entries needs the JSON format, which records when each was hashed, not %s", format)
+		}
+		for _, r := range roots {
+			unlock, err := acquireLock(r.lock)
+			if err != nil {
+				return VerifyResult{}, err
+			}
+			defer unlock()
+		}
+	}
+	// touched holds the time each entry that matched was checked, with
+	// TouchUnchanged.
+	touched := make(map[string]time.Time)
+	var cp *checkpoint
+	var confirmed map[string]bool
+	if s.VerifyCheckpoint != "" {
+		cp, confirmed, err = openCheckpoint(s.VerifyCheckpoint, refPath)
+		if err != nil {
+			return VerifyResult{}, fmt.Errorf("checkpoint: %w", err)
+		}
+		if len(confirmed) > 0 {
+			s.logf("Resuming from %s, skipping %d confirmed entries", s.VerifyCheckpoint, len(confirmed))
+		}
+	}
+	verifier := *s
+	verifier.FollowSymlinks = header.FollowSymlinks
+	w := newWalker(&verifier, roots, outputPath)
+	if s.Database != "" {
+		for _, suffix := range dbSidecars {
+			w.skip[outputPath+suffix] = true
+		}
+	}
+	if s.PerDir {
+		w.ownName = filepath.Base(outputPath)
+	}
+
+	start := time.Now()
+	pending := make(chan hashJob, s.queueSize())
+	results := hashWorkers(ctx, s.jobs(), s.readOptions(), newHash, pending)
+	// Members of a listed archive are checked when the archive is hashed.
+	members := make(map[string][]string)
+	for key := range checksums {
+		if archive := archiveOf(key); archive != "" {
+			if _, listed := checksums[archive]; listed {
+				members[archive] = append(members[archive], key)
+			}
+		}
+	}
+	res := VerifyResult{Entries: len(checksums)}
+	// sampled holds the entries to check with VerifySample, and is nil
+	// when every entry is checked.
+	var sampled map[string]bool
+	if s.VerifySample > 0 {
+		res.Seed = s.SampleSeed
+		if res.Seed == 0 {
+			res.Seed = rand.Int64()
+		}
+		res.Sampled = sample(checksums, members, s.VerifySample, res.Seed)
+		sampled = make(map[string]bool, len(res.Sampled))
+		for _, key := range res.Sampled {
+			sampled[key] = true
+		}
+		s.logf("Sampling %d entries with seed %d", len(res.Sampled), res.Seed)
+	}
+	// special holds the listed entries that are not regular files. It is
+	// only appended to before pending is closed, so it is complete once
+	// results is drained.
+	var special []string
+	go func() {
+		defer close(pending)
+		defer s.walked()
+		for key := range checksums {
+			if archive := archiveOf(key); archive != "" && members[archive] != nil {
+				continue
+			}
+			if isDirKey(key) {
+				continue
+			}
+			if confirmed[key] || (sampled != nil && !sampled[key]) {
+				continue
+			}
+			r, relPath, ok := locate(roots, key)
+			if !ok {
+				// An empty path fails to open and is reported as missing.
+				relPath = ""
+			}
+			path := joinRoot(r, relPath)
+			if info, err := os.Stat(path); err == nil && !info.Mode().IsRegular() {
+				// Opening a FIFO would block until a writer appears.
+				special = append(special, key)
+				continue
+			}
+			s.countQueued(checksums[key].Size)
+			select {
+			case pending <- hashJob{path: path, relPath: key, archive: members[key] != nil, metadata: header.Algorithm == MetadataAlgorithm}:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	for key := range confirmed {
+		if _, ok := checksums[key]; ok {
+			res.Resumed++
+		}
+	}
+	for hr := range results {
+		problems := res.problems()
+		if !os.IsNotExist(hr.err) {
+			s.countHashed(hr.bytes)
+		}
+		switch {
+		case os.IsNotExist(hr.err):
+			res.Missing = append(res.Missing, hr.relPath)
+			res.Missing = append(res.Missing, members[hr.relPath]...)
+		case hr.err != nil:
+			s.errorf("Checksum failed: %s - %v", hr.path, hr.err)
+			res.Failed = append(res.Failed, hr.relPath)
+		case hr.sum != checksums[hr.relPath].Hash:
+			res.Mismatched = append(res.Mismatched, hr.relPath)
+		case checksums[hr.relPath].Mode != "":
+			if info, err := os.Stat(hr.path); err == nil && permBits(info) != checksums[hr.relPath].Mode {
+				res.ModeChanged = append(res.ModeChanged, hr.relPath)
+			}
+		}
+		if hr.archive && hr.err == nil {
+			res.verifyMembers(hr, members[hr.relPath], checksums)
+		}
+		if hr.err == nil && res.problems() == problems {
+			if cp != nil {
+				cp.add(hr.relPath)
+			}
+			if s.TouchUnchanged {
+				touched[hr.relPath] = time.Now()
+			}
+		}
+	}
+
+	for _, key := range special {
+		s.errorf("Checksum failed: %s - not a regular file", key)
+		res.Failed = append(res.Failed, key)
+	}
+
+	// An empty directory's entry only asks for a directory to be there;
+	// one that now holds files is not reported.
+	for key := range checksums {
+		if !isDirKey(key) || confirmed[key] || (sampled != nil && !sampled[key]) || ctx.Err() != nil {
+			continue
+		}
+		path := ""
+		if r, relPath, ok := locate(roots, strings.TrimSuffix(key, "/")); ok {
+			path = joinRoot(r, relPath)
+		}
+		info, err := os.Stat(path)
+		switch {
+		case err != nil:
+			res.Missing = append(res.Missing, key)
+		case !info.IsDir():
+			res.Mismatched = append(res.Mismatched, key)
+		case cp != nil:
+			cp.add(key)
+		}
+	}
+
+	// A sample checks too few entries to say anything of the rest of the
+	// tree.
+	for _, r := range roots {
+		if sampled != nil {
+			break
+		}
+		w.walk(ctx, r.dir, func(path, relPath string, info os.FileInfo) error {
+			key := r.key(relPath)
+			if info.IsDir() {
+				key += "/"
+			} else if !s.sizeAllowed(info) {
+				return nil
+			}
+			if !fileExistsInChecksums(key, checksums) {
+				res.Unlisted = append(res.Unlisted, key)
+			}
+			return nil
+		}, func(string, error) {})
+	}
+
+	for _, paths := range [][]string{res.Mismatched, res.Missing, res.Failed, res.ModeChanged, res.Unlisted} {
+		sort.Strings(paths)
+	}
+	res.Duration = time.Since(start)
+	// A checkpoint is tied to the checksum file as it was, so the file is
+	// only rewritten once nothing is left to resume.
+	if len(touched) > 0 && ctx.Err() == nil {
+		for key, at := range touched {
+			rec := checksums[key]
+			rec.HashedAt = at
+			checksums[key] = rec
+		}
+		if err := writeChecksums(refPath, checksums, header, FormatJSON, nil); err != nil {
+			return res, fmt.Errorf("failed to record the verification in %s: %w", refPath, err)
+		}
+		res.Touched = len(touched)
+		s.logf("Recorded the verification of %d entries in %s", res.Touched, refPath)
+		if err := s.resign(refPath); err != nil {
+			return res, err
+		}
+	}
+	if cp != nil {
+		if err := cp.close(ctx.Err() == nil); err != nil {
+			s.errorf("WARNING: checkpoint %s: %v", s.VerifyCheckpoint, err)
+		}
+	}
+	return res, ctx.Err()
+}
+
+// sample picks percent of the entries in checksums, rounded up, by a
+// shuffle seeded with seed, and returns them sorted. Archive members, in
+// members by archive, are left out since they are checked with their
+// archive.
+func sample(checksums map[string]Record, members map[string][]string, percent float64, seed int64) []string {
+	var keys []string
+	for key := range checksums {
+		if archive := archiveOf(key); archive == "" || members[archive] == nil {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	n := min(len(keys), int(math.Ceil(float64(len(keys))*percent/100)))
+	rng := rand.New(rand.NewPCG(uint64(seed), 0))
+	rng.Shuffle(len(keys), func(i, j int) { keys[i], keys[j] = keys[j], keys[i] })
+	keys = keys[:n]
+	sort.Strings(keys)
+	return keys
+}
+
+// problems returns the number of discrepancies recorded so far.
+func (r VerifyResult) problems() int {
+	return len(r.Mismatched) + len(r.Missing) + len(r.Failed) + len(r.ModeChanged) + len(r.Unlisted)
+}
+
+// verifyMembers compares the members hashed from an archive with the
+// listed member keys of that archive.
+func (res *VerifyResult) verifyMembers(hr hashResult, listed []string, checksums map[string]Record) {
+	got := make(map[string]string, len(hr.members))
+	for _, m := range hr.members {
+		got[m.key] = m.sum
+		if _, ok := checksums[m.key]; !ok {
+			res.Unlisted = append(res.Unlisted, m.key)
+		}
+	}
+	for _, key := range listed {
+		sum, ok := got[key]
+		switch {
+		case !ok:
+			res.Missing = append(res.Missing, key)
+		case sum != checksums[key].Hash:
+			res.Mismatched = append(res.Mismatched, key)
+		}
+	}
+}
+
+// joinRoot returns the path of the slash-separated relPath below r, or ""
+// if relPath is empty.
+func joinRoot(r root, relPath string) string {
+	if relPath == "" {
+		return ""
+	}
+	return filepath.Join(r.dir, filepath.FromSlash(relPath))
+}
@@ -0,0 +1,507 @@
+package incmd5
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// walker selects the files a scan or verification visits.
+type walker struct {
+	*Scanner
+	// skip holds the absolute paths of the tool's own files, which are
+	// never visited.
+	skip map[string]bool
+	// output is the checksum file as it existed before the walk, so that
+	// it is also recognized when reached through another path.
+	output os.FileInfo
+	// ignores holds the rules of the ignore files read so far in the
+	// current walk.
+	ignores []ignoreRule
+	// ownName, in PerDir mode, is the name of the checksum file kept in
+	// every directory, which is skipped wherever it appears.
+	ownName string
+	// dirIgnores caches the rules of each directory's ignore file for
+	// visitList, keyed by relative path.
+	dirIgnores map[string][]ignoreRule
+	// reads, if non-nil, holds a token for each directory being read
+	// ahead of the walk, bounding how many are read at once.
+	reads chan struct{}
+	// shards, if the checksum file is sharded, is its directory, nothing
+	// below which is visited.
+	shards string
+}
+
+// newWalker returns a walker for s that skips the timestamp and lock files
+// of roots and the checksum file at outputPath, along with the temporary
+// file it is written through and its signature, or everything below it
+// if it is sharded. Files elsewhere that merely share one of their names
+// are visited as usual.
+func newWalker(s *Scanner, roots []root, outputPath string) *walker {
+	skip := map[string]bool{outputPath: true, outputPath + ".tmp": true, outputPath + SignatureSuffix: true, outputPath + SignatureSuffix + ".tmp": true}
+	for _, r := range roots {
+		skip[r.timestamp] = true
+		skip[r.lock] = true
+	}
+	var output os.FileInfo
+	if outputPath != StdoutPath {
+		output, _ = os.Stat(outputPath)
+	}
+	w := &walker{Scanner: s, skip: skip, output: output}
+	if IsSharded(outputPath) {
+		w.shards = outputPath
+	}
+	if s.WalkJobs > 1 {
+		w.reads = make(chan struct{}, s.WalkJobs)
+	}
+	return w
+}
+
+// isOutput reports whether info describes the checksum file.
+func (w *walker) isOutput(info os.FileInfo) bool {
+	return w.output != nil && os.SameFile(w.output, info)
+}
+
+// inShards reports whether path lies in the directory of a sharded
+// checksum file.
+func (w *walker) inShards(path string) bool {
+	return w.shards != "" && within(w.shards, path)
+}
+
+// within reports whether path is dir or lies below it.
+func within(dir, path string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && filepath.IsLocal(rel)
+}
+
+// isOwnName reports whether name is that of a PerDir checksum file or of
+// the temporary file it is written through.
+func (w *walker) isOwnName(name string) bool {
+	return w.ownName != "" && (name == w.ownName || name == w.ownName+".tmp")
+}
+
+// visitFunc receives each file selected by a walk: the path to open, its
+// path relative to the scan root, and its info.
+type visitFunc func(path, relPath string, info os.FileInfo) error
+
+// walk calls visit for every regular file under root that is not excluded,
+// passing its path relative to root, and with EmptyDirs for every empty
+// directory below root too. Excluded directories are skipped
+// entirely. Paths the walk could not read, with the error, and directories
+// beyond MaxDepth, with a nil error, are passed to unreadable so that their
+// entries are kept. The
+// walk stops early if ctx is cancelled or visit returns an error.
+func (w *walker) walk(ctx context.Context, root string, visit visitFunc, unreadable func(relPath string, err error)) error {
+	w.ignores = nil
+	return w.walkDir(ctx, root, "", nil, visit, unreadable)
+}
+
+// walkDir walks dir, reporting paths relative to the scan root as relBase
+// joined with the path below dir. linkDirs holds the directories of the
+// symlinks followed to reach dir, for loop detection.
+func (w *walker) walkDir(ctx context.Context, dir, relBase string, linkDirs []string, visit visitFunc, unreadable func(relPath string, err error)) error {
+	walk := filepath.Walk
+	if w.reads != nil {
+		walk = func(root string, fn filepath.WalkFunc) error {
+			return walkAhead(root, w.reads, fn)
+		}
+	}
+	return walk(dir, func(path string, info os.FileInfo, err error) error {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		rel, relErr := filepath.Rel(dir, path)
+		if relErr != nil {
+			w.errorf("Relative path error: %s - %v", path, relErr)
+			return nil
+		}
+		relPath := filepath.Join(relBase, rel)
+		if err != nil && (info == nil || !info.IsDir()) {
+			if !matchesAny(relPath, w.Excludes) && !ignored(w.ignores, relPath, false) {
+				unreadable(relPath, err)
+			}
+			return nil
+		}
+
+		if info.IsDir() {
+			if w.skip[path] {
+				w.tracef("SKIPPING %s", relPath)
+				return filepath.SkipDir
+			}
+			if relPath != "." && matchesAny(relPath, w.Excludes) {
+				w.tracef("Excluding %s", relPath)
+				return filepath.SkipDir
+			}
+			if relPath != "." && w.MaxDepth > 0 && strings.Count(relPath, string(filepath.Separator)) >= w.MaxDepth-1 {
+				w.tracef("Skipping %s, deeper than the depth limit", relPath)
+				unreadable(relPath, nil)
+				return filepath.SkipDir
+			}
+			if relPath != "." && ignored(w.ignores, relPath, true) {
+				w.tracef("Ignoring %s", relPath)
+				return filepath.SkipDir
+			}
+			if err != nil {
+				// Only a directory the walk would have entered is reported.
+				unreadable(relPath, &listError{Err: err})
+				return nil
+			}
+			w.readIgnores(path, relPath)
+			if w.EmptyDirs && relPath != "." && isEmptyDir(path) {
+				return visit(path, relPath, info)
+			}
+			return nil
+		}
+		return w.visitFile(ctx, path, relPath, info, linkDirs, visit, unreadable)
+	})
+}
+
+// listError wraps the error of a directory the walk could not list, and
+// so could not descend into.
+type listError struct {
+	Err error
+}
+
+func (e *listError) Error() string {
+	return "cannot list directory: " + e.Err.Error()
+}
+
+func (e *listError) Unwrap() error {
+	return e.Err
+}
+
+// walkAhead is filepath.Walk reading directories ahead of fn: once fn
+// enters a directory, its subdirectories are listed and their entries
+// lstat'ed concurrently, holding a token of reads for each, while fn works
+// through the entries in order. fn sees the same calls in the same order
+// as with filepath.Walk, so returning filepath.SkipDir still prunes a
+// directory; the listing read for it ahead is discarded.
+func walkAhead(root string, reads chan struct{}, fn filepath.WalkFunc) error {
+	r := &dirReader{reads: reads, stop: make(chan struct{})}
+	defer close(r.stop)
+	info, err := os.Lstat(root)
+	if err != nil {
+		err = fn(root, nil, err)
+	} else {
+		var l *listing
+		if info.IsDir() {
+			l = r.list(root)
+		}
+		err = r.walk(root, info, l, fn)
+	}
+	if err == filepath.SkipDir || err == filepath.SkipAll {
+		return nil
+	}
+	return err
+}
+
+// dirReader lists directories for walkAhead.
+type dirReader struct {
+	reads chan struct{}
+	// stop is closed when the walk ends, so that listings not yet started
+	// are abandoned.
+	stop chan struct{}
+}
+
+// listing is the sorted contents of a directory, with the Lstat result of
+// each entry, available once ready is closed.
+type listing struct {
+	entries []dirEntry
+	err     error
+	ready   chan struct{}
+}
+
+type dirEntry struct {
+	name string
+	info os.FileInfo
+	err  error
+}
+
+// errWalkEnded fills the listings abandoned when a walk ends.
+var errWalkEnded = errors.New("walk ended")
+
+// list starts reading dir in the background.
+func (r *dirReader) list(dir string) *listing {
+	l := &listing{ready: make(chan struct{})}
+	go func() {
+		defer close(l.ready)
+		select {
+		case r.reads <- struct{}{}:
+		case <-r.stop:
+			l.err = errWalkEnded
+			return
+		}
+		defer func() { <-r.reads }()
+		l.entries, l.err = readDirEntries(dir)
+	}()
+	return l
+}
+
+// walk mirrors the recursion of filepath.Walk for path, whose listing l
+// has been started if it is a directory.
+func (r *dirReader) walk(path string, info os.FileInfo, l *listing, fn filepath.WalkFunc) error {
+	if !info.IsDir() {
+		return fn(path, info, nil)
+	}
+	<-l.ready
+	err := fn(path, info, l.err)
+	if l.err != nil || err != nil {
+		return err
+	}
+	subdirs := make([]*listing, len(l.entries))
+	for i, e := range l.entries {
+		if e.err == nil && e.info.IsDir() {
+			subdirs[i] = r.list(filepath.Join(path, e.name))
+		}
+	}
+	for i, e := range l.entries {
+		name := filepath.Join(path, e.name)
+		if e.err != nil {
+			if err := fn(name, e.info, e.err); err != nil && err != filepath.SkipDir {
+				return err
+			}
+			continue
+		}
+		if err := r.walk(name, e.info, subdirs[i], fn); err != nil {
+			if !e.info.IsDir() || err != filepath.SkipDir {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// readDirEntries returns the entries of dir sorted by name, each with its
+// Lstat result.
+func readDirEntries(dir string) ([]dirEntry, error) {
+	file, err := os.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	names, err := file.Readdirnames(-1)
+	file.Close()
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+	entries := make([]dirEntry, len(names))
+	for i, name := range names {
+		info, err := os.Lstat(filepath.Join(dir, name))
+		entries[i] = dirEntry{name: name, info: info, err: err}
+	}
+	return entries, nil
+}
+
+// readIgnores adds the rules of the ignore file in dir, if any, to those
+// of the current walk.
+func (w *walker) readIgnores(dir, relPath string) {
+	w.ignores = append(w.ignores, w.ignoreRules(dir, relPath)...)
+}
+
+// ignoreRules returns the rules of the ignore file in dir, found at
+// relPath below the scan root.
+func (w *walker) ignoreRules(dir, relPath string) []ignoreRule {
+	if w.IgnoreFile == "" {
+		return nil
+	}
+	rules, err := readIgnoreFile(filepath.Join(dir, w.IgnoreFile), relPath)
+	if err != nil {
+		w.errorf("Cannot read ignore file in %s - %v", relPath, err)
+	}
+	return rules
+}
+
+// listIgnores sets the rules of the current walk to those that apply to
+// the listed file relPath below root, as if the walk had reached it, and
+// reports whether one of its parent directories is ignored.
+func (w *walker) listIgnores(root, relPath string) bool {
+	if w.dirIgnores == nil {
+		w.dirIgnores = make(map[string][]ignoreRule)
+	}
+	w.ignores = nil
+	dir := "."
+	for _, elem := range append([]string{""}, strings.Split(filepath.Dir(relPath), string(filepath.Separator))...) {
+		if elem == "." {
+			break
+		}
+		dir = filepath.Join(dir, elem)
+		if dir != "." && ignored(w.ignores, dir, true) {
+			return true
+		}
+		rules, ok := w.dirIgnores[dir]
+		if !ok {
+			rules = w.ignoreRules(filepath.Join(root, dir), dir)
+			w.dirIgnores[dir] = rules
+		}
+		w.ignores = append(w.ignores, rules...)
+	}
+	return false
+}
+
+// visitFile applies the scanner's filters to a non-directory entry and
+// passes it to visit, resolving symlinks if they are followed.
+func (w *walker) visitFile(ctx context.Context, path, relPath string, info os.FileInfo, linkDirs []string, visit visitFunc, unreadable func(relPath string, err error)) error {
+	if w.skip[path] || w.isOutput(info) || w.isOwnName(info.Name()) || w.inShards(path) {
+		w.tracef("SKIPPING %s", relPath)
+		return nil
+	}
+	if matchesAny(relPath, w.Excludes) {
+		w.tracef("Excluding %s", relPath)
+		return nil
+	}
+	if ignored(w.ignores, relPath, false) {
+		w.tracef("Ignoring %s", relPath)
+		return nil
+	}
+	if len(w.Includes) > 0 && !matchesAny(relPath, w.Includes) {
+		w.tracef("Not included %s", relPath)
+		return nil
+	}
+	if len(w.Extensions) > 0 && !hasExtension(relPath, w.Extensions) {
+		w.tracef("Not included %s", relPath)
+		return nil
+	}
+
+	if info.Mode()&os.ModeSymlink != 0 {
+		if !w.FollowSymlinks {
+			w.tracef("Skipping symlink %s", relPath)
+			return nil
+		}
+		target, err := filepath.EvalSymlinks(path)
+		if err != nil {
+			w.logf("Broken symlink: %s - %v", relPath, err)
+			return nil
+		}
+		targetInfo, err := os.Stat(target)
+		if err != nil {
+			w.logf("Broken symlink: %s - %v", relPath, err)
+			return nil
+		}
+		if !targetInfo.IsDir() {
+			if !targetInfo.Mode().IsRegular() {
+				w.tracef("Skipping special file %s", relPath)
+				return nil
+			}
+			if w.isOutput(targetInfo) || w.inShards(target) {
+				w.tracef("SKIPPING %s", relPath)
+				return nil
+			}
+			return visit(target, relPath, targetInfo)
+		}
+		chain := append(append([]string(nil), linkDirs...), filepath.Dir(path))
+		if isAncestor(targetInfo, chain) {
+			w.logf("Skipping symlink loop %s -> %s", relPath, target)
+			return nil
+		}
+		return w.walkDir(ctx, target, relPath, chain, visit, unreadable)
+	}
+	if !info.Mode().IsRegular() {
+		// Opening a FIFO would block until a writer appears.
+		w.tracef("Skipping special file %s", relPath)
+		return nil
+	}
+	return visit(path, relPath, info)
+}
+
+// visitList passes each listed file under root to visit, applying the same
+// filters as walk. Listed paths may be relative to root or absolute paths
+// inside it; missing files and directories are logged and skipped.
+func (w *walker) visitList(ctx context.Context, root string, files []string, visit visitFunc, unreadable func(relPath string, err error)) error {
+	for _, name := range files {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		relPath := filepath.Clean(filepath.FromSlash(name))
+		if filepath.IsAbs(relPath) {
+			rel, err := filepath.Rel(root, relPath)
+			if err != nil {
+				w.errorf("Relative path error: %s - %v", name, err)
+				continue
+			}
+			relPath = rel
+		}
+		if relPath == "." || relPath == ".." || strings.HasPrefix(relPath, ".."+string(filepath.Separator)) {
+			w.logf("Outside of %s: %s", root, name)
+			continue
+		}
+
+		if w.CaseInsensitive {
+			relPath = diskCase(root, relPath)
+		}
+		path := filepath.Join(root, relPath)
+		info, err := os.Lstat(path)
+		if err != nil {
+			if w.pruneListed {
+				w.tracef("Listed file not found: %s - %v", name, err)
+			} else {
+				w.logf("Listed file not found: %s - %v", name, err)
+			}
+			continue
+		}
+		if info.IsDir() {
+			w.tracef("Skipping listed directory %s", relPath)
+			continue
+		}
+		if w.listIgnores(root, relPath) {
+			w.tracef("Ignoring %s", relPath)
+			continue
+		}
+		if err := w.visitFile(ctx, path, relPath, info, nil, visit, unreadable); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// diskCase returns relPath below root with each element spelled as in its
+// directory listing, picking an exact match over one that differs only in
+// case. Elements that cannot be found are left as they are.
+func diskCase(root, relPath string) string {
+	elems := strings.Split(relPath, string(filepath.Separator))
+	dir := root
+	for i, elem := range elems {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			break
+		}
+		match := ""
+		for _, e := range entries {
+			if e.Name() == elem {
+				match = elem
+				break
+			}
+			if match == "" && strings.EqualFold(e.Name(), elem) {
+				match = e.Name()
+			}
+		}
+		if match != "" {
+			elems[i] = match
+		}
+		dir = filepath.Join(dir, elems[i])
+	}
+	return filepath.Join(elems...)
+}
+
+// isAncestor reports whether dir is the same file as any of the given
+// directories or one of their ancestors. Following a symlink to such a
+// directory would re-enter a tree that is already being walked. Files are
+// compared by identity (device and inode on Unix) so that bind mounts and
+// alternate spellings of the same path are caught too.
+func isAncestor(dir os.FileInfo, dirs []string) bool {
+	for _, d := range dirs {
+		for {
+			if info, err := os.Stat(d); err == nil && os.SameFile(dir, info) {
+				return true
+			}
+			parent := filepath.Dir(d)
+			if parent == d {
+				break
+			}
+			d = parent
+		}
+	}
+	return false
+}
@@ -0,0 +1,63 @@
+package incmd5
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// lockDir makes the directory at path unlistable until the test ends,
+// skipping the test where permissions are not enforced, as for root.
+func lockDir(t *testing.T, path string) {
+	t.Helper()
+	if err := os.Chmod(path, 0); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chmod(path, 0755) })
+	if _, err := os.ReadDir(path); err == nil {
+		t.Skip("directory permissions are not enforced for this user")
+	}
+}
+
+func TestUnreadableDir(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"a.txt":           "a",
+		"locked/b.txt":    "b",
+		"excluded/c.txt":  "c",
+		"ignored/d.txt":   "d",
+		DefaultIgnoreFile: "ignored/\n",
+	})
+	output := filepath.Join(t.TempDir(), "md5sums.txt")
+	s := &Scanner{Output: output, Excludes: []string{"excluded"}, IgnoreFile: DefaultIgnoreFile}
+	if _, err := s.Scan(dir); err != nil {
+		t.Fatal(err)
+	}
+	lockDir(t, filepath.Join(dir, "locked"))
+	// Directories that would not be walked anyway are not reported.
+	lockDir(t, filepath.Join(dir, "excluded"))
+	lockDir(t, filepath.Join(dir, "ignored"))
+
+	res, err := s.Scan(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(res.UnreadableDirs, []string{"locked"}) {
+		t.Errorf("UnreadableDirs = %q, want [locked]", res.UnreadableDirs)
+	}
+	if len(res.Failed) != 1 || res.Failed[0].Path != "locked" || !errors.Is(res.Failed[0].Err, os.ErrPermission) {
+		t.Errorf("Failed = %v, want locked denied", res.Failed)
+	}
+	if _, ok := res.Checksums["locked/b.txt"]; !ok || len(res.Removed) > 0 {
+		t.Errorf("entries below the unreadable directory were pruned: %q", res.Removed)
+	}
+
+	s.FailOnError = true
+	_, err = s.Scan(dir)
+	var failed *FailedError
+	if !errors.As(err, &failed) {
+		t.Errorf("FailOnError: got %v, want a *FailedError", err)
+	}
+}
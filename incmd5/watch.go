@@ -0,0 +1,157 @@
+package incmd5
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// WatchContext scans dir like ScanContext, then keeps watching it and,
+// once a burst of filesystem events has been quiet for debounce, rescans
+// only the paths the events named. Created and written files are rehashed,
+// removed or renamed ones are pruned along with everything below them, and
+// the checksum file is rewritten whenever an entry changes. Editors that
+// save by writing a temp file and renaming it over the original are seen
+// as a change to the original. If the kernel drops events, the whole tree
+// is rescanned.
+//
+// report is called with the result of the initial scan and of every
+// rescan. WatchContext returns ctx.Err() once ctx is cancelled, or an
+// error if the initial scan or the watch itself fails; a failed rescan is
+// passed to report and watching goes on.
+func (s *Scanner) WatchContext(ctx context.Context, dir string, debounce time.Duration, report func(Result, error)) error {
+	if s.Files != nil || s.GitRange != "" {
+		return errors.New("watching does not support a file list or git range")
+	}
+	res, err := s.ScanContext(ctx, dir)
+	report(res, err)
+	if err != nil {
+		return err
+	}
+	roots, outputPath, err := s.resolve([]string{dir})
+	if err != nil {
+		return err
+	}
+	r := roots[0]
+	sharded := IsSharded(outputPath)
+	own := map[string]bool{outputPath: true, outputPath + ".tmp": true, outputPath + SignatureSuffix: true, outputPath + SignatureSuffix + ".tmp": true, r.timestamp: true, r.lock: true}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+	addTree := func(path string) {
+		filepath.WalkDir(path, func(path string, d fs.DirEntry, err error) error {
+			if err != nil || !d.IsDir() {
+				return nil
+			}
+			if sharded && path == outputPath {
+				return filepath.SkipDir
+			}
+			if rel, err := filepath.Rel(r.dir, path); err == nil && rel != "." && matchesAny(rel, s.Excludes) {
+				return filepath.SkipDir
+			}
+			if err := watcher.Add(path); err != nil {
+				s.errorf("Cannot watch %s - %v", path, err)
+			}
+			return nil
+		})
+	}
+	addTree(r.dir)
+	s.logf("Watching %s", r.dir)
+
+	pending := make(map[string]bool)
+	full := false
+	timer := time.NewTimer(debounce)
+	timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return nil
+			}
+			if own[event.Name] || sharded && within(outputPath, event.Name) {
+				continue
+			}
+			switch {
+			case event.Has(fsnotify.Create):
+				if info, err := os.Lstat(event.Name); err == nil && info.IsDir() {
+					addTree(event.Name)
+				}
+			case event.Has(fsnotify.Remove), event.Has(fsnotify.Rename):
+				// A directory moved elsewhere would keep reporting events
+				// under its old name.
+				watcher.Remove(event.Name)
+			}
+			pending[event.Name] = true
+			timer.Reset(debounce)
+
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return nil
+			}
+			s.errorf("Watch error: %v", err)
+			if errors.Is(err, fsnotify.ErrEventOverflow) {
+				full = true
+				timer.Reset(debounce)
+			}
+
+		case <-timer.C:
+			rescan := *s
+			if !full {
+				rescan.Files = changedFiles(r.dir, pending)
+				rescan.Force = true
+				rescan.pruneListed = true
+			}
+			pending = make(map[string]bool)
+			full = false
+			res, err := rescan.ScanContext(ctx, dir)
+			report(res, err)
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+		}
+	}
+}
+
+// changedFiles returns the sorted paths relative to root named by events,
+// with directories expanded to the files below them. Paths that no longer
+// exist are kept so that their entries can be pruned.
+func changedFiles(root string, events map[string]bool) []string {
+	set := make(map[string]bool)
+	for path := range events {
+		rel, err := filepath.Rel(root, path)
+		if err != nil || !filepath.IsLocal(rel) {
+			continue
+		}
+		info, err := os.Lstat(path)
+		if err != nil || !info.IsDir() {
+			set[rel] = true
+			continue
+		}
+		filepath.WalkDir(path, func(sub string, d fs.DirEntry, err error) error {
+			if err == nil && !d.IsDir() {
+				if rel, err := filepath.Rel(root, sub); err == nil {
+					set[rel] = true
+				}
+			}
+			return nil
+		})
+	}
+	files := make([]string, 0, len(set))
+	for rel := range set {
+		files = append(files, rel)
+	}
+	sort.Strings(files)
+	return files
+}
@@ -0,0 +1,70 @@
+package incmd5
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWatchShardedOutputInsideDir(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{"a.txt": "a", "b/c.txt": "c"})
+	s := &Scanner{Output: filepath.Join(dir, "sums"+ShardSuffix), LogLevel: LogQuiet}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	type report struct {
+		res Result
+		err error
+	}
+	reports := make(chan report, 100)
+	done := make(chan error, 1)
+	go func() {
+		done <- s.WatchContext(ctx, dir, 20*time.Millisecond, func(res Result, err error) {
+			reports <- report{res, err}
+		})
+	}()
+	next := func(wait time.Duration) (report, bool) {
+		select {
+		case r := <-reports:
+			if r.err != nil {
+				t.Fatal(r.err)
+			}
+			for key := range r.res.Checksums {
+				if strings.HasPrefix(key, "sums"+ShardSuffix+"/") {
+					t.Errorf("recorded the shard %s", key)
+				}
+			}
+			return r, true
+		case err := <-done:
+			t.Fatalf("watch returned %v", err)
+		case <-time.After(wait):
+		}
+		return report{}, false
+	}
+	if _, ok := next(5 * time.Second); !ok {
+		t.Fatal("no initial scan")
+	}
+
+	// Give the watcher time to be set up before the change.
+	time.Sleep(100 * time.Millisecond)
+	writeFiles(t, dir, map[string]string{"b/d.txt": "d"})
+	r, ok := next(5 * time.Second)
+	if !ok {
+		t.Fatal("no rescan after a change")
+	}
+	if want := []string{"b/d.txt"}; !slices.Equal(r.res.Added, want) {
+		t.Errorf("added %q, want %q", r.res.Added, want)
+	}
+	// Rewriting the shards must not set off another rescan.
+	if r, ok := next(500 * time.Millisecond); ok {
+		t.Errorf("rescan after writing the shards: %+v", r.res)
+	}
+	cancel()
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Errorf("watch returned %v, want %v", err, context.Canceled)
+	}
+}
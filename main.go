@@ -2,219 +2,1157 @@ package main
 
 import (
 	"bufio"
-	"crypto/md5"
-	"encoding/hex"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"log"
+	"math"
 	"os"
+	"os/exec"
+	"os/signal"
 	"path/filepath"
-	"sort"
+	"runtime"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
+
+	"golang.org/x/term"
+
+	"incrementalmd5/incmd5"
 )
 
-var (
-	MD5TimestampFile = ".md5sum-timestamp"
+// Exit statuses of a scan, listed by -help. Fatal errors exit 1 through
+// log.Fatal and flag errors exit 2; a verification exits 1 if any file
+// fails to match.
+const (
+	// exitChanged means the checksum file was rewritten, or in a dry run
+	// would have been.
+	exitChanged = 3
+	// exitPartial means some files could not be hashed; it takes
+	// precedence over exitChanged and exitBaseline.
+	exitPartial = 4
+	// exitBaseline means the tree differs from the -baseline checksums,
+	// or the files given to -compare differ; it takes precedence over
+	// exitChanged.
+	exitBaseline = 5
+	// exitInterrupted is the conventional status for a run stopped by
+	// SIGINT.
+	exitInterrupted = 130
 )
 
+// exitStatusHelp documents the exit statuses at the end of -help.
+const exitStatusHelp = `
+Exit status:
+  0    no changes
+  1    fatal error, or -verify or -compare-with-verify found a discrepancy
+  2    invalid command line
+  3    checksum file updated (or, with -dry-run, would be)
+  4    some files could not be hashed; their entries were left as they were
+  5    the tree differs from the -baseline checksums, or -compare found differences
+  130  interrupted
+`
+
+// progressInterval is how often -progress prints a status line.
+const progressInterval = 500 * time.Millisecond
+
+// watchDebounce is how long -watch waits for events to stop before
+// rescanning.
+const watchDebounce = time.Second
+
+// stringList is a flag.Value collecting every occurrence of a repeated flag.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// byteSize is a flag.Value for a size in bytes, accepting an optional K, M
+// or G suffix for powers of 1024.
+type byteSize int
+
+func (b *byteSize) String() string {
+	n := int(*b)
+	for _, unit := range []struct {
+		suffix string
+		size   int
+	}{{"G", 1 << 30}, {"M", 1 << 20}, {"K", 1 << 10}} {
+		if n >= unit.size && n%unit.size == 0 {
+			return strconv.Itoa(n/unit.size) + unit.suffix
+		}
+	}
+	return strconv.Itoa(n)
+}
+
+func (b *byteSize) Set(value string) error {
+	multiplier := 1
+	number := strings.TrimSuffix(strings.ToUpper(value), "B")
+	if n := len(number); n > 0 {
+		switch number[n-1] {
+		case 'K':
+			multiplier = 1 << 10
+		case 'M':
+			multiplier = 1 << 20
+		case 'G':
+			multiplier = 1 << 30
+		}
+		if multiplier > 1 {
+			number = number[:n-1]
+		}
+	}
+	n, err := strconv.Atoi(number)
+	if err != nil || n < 1 {
+		return fmt.Errorf("invalid size %q", value)
+	}
+	*b = byteSize(n * multiplier)
+	return nil
+}
+
+// sinceTime is a flag.Value for a point in time, given in RFC 3339 form or
+// as a duration before now such as 24h.
+type sinceTime struct{ t *time.Time }
+
+func (s sinceTime) String() string {
+	if s.t == nil || s.t.IsZero() {
+		return ""
+	}
+	return s.t.Format(time.RFC3339)
+}
+
+func (s sinceTime) Set(value string) error {
+	if d, err := time.ParseDuration(value); err == nil {
+		*s.t = time.Now().Add(-d)
+		return nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return fmt.Errorf("invalid time %q: want RFC 3339 or a duration like 24h", value)
+	}
+	*s.t = t
+	return nil
+}
+
+// logLevel is set from -quiet and -verbose.
+var logLevel = incmd5.LogNormal
+
+// infof logs a summary or warning message unless -quiet is set.
+func infof(format string, args ...any) {
+	if logLevel != incmd5.LogQuiet {
+		log.Printf(format, args...)
+	}
+}
+
+// humanReadable is set by -human to log sizes and durations in units
+// rather than as raw byte counts and Go durations.
+var humanReadable bool
+
+// formatBytes formats n bytes for a log line: as a count of bytes, or with
+// -human in the largest binary unit that keeps it at least 1, such as
+// 1.2 GiB.
+func formatBytes(n int64) string {
+	if !humanReadable {
+		return strconv.FormatInt(n, 10) + " bytes"
+	}
+	if n < 1<<10 {
+		return strconv.FormatInt(n, 10) + " B"
+	}
+	value, unit := float64(n)/(1<<10), 0
+	for value >= 1<<10 && unit < 4 {
+		value /= 1 << 10
+		unit++
+	}
+	return fmt.Sprintf("%.1f %ciB", value, "KMGTP"[unit])
+}
+
+// formatRate formats a throughput of bytesPerSecond like formatBytes.
+func formatRate(bytesPerSecond float64) string {
+	if math.IsNaN(bytesPerSecond) || math.IsInf(bytesPerSecond, 0) {
+		bytesPerSecond = 0
+	}
+	return formatBytes(int64(bytesPerSecond)) + "/s"
+}
+
+// formatDuration formats d for a log line: as a Go duration, or with
+// -human rounded to what a reader cares about, such as 850ms, 12.5s or
+// 3m04s.
+func formatDuration(d time.Duration) string {
+	if !humanReadable {
+		return d.String()
+	}
+	switch {
+	case d < time.Second:
+		return d.Round(time.Millisecond).String()
+	case d < time.Minute:
+		return fmt.Sprintf("%.1fs", d.Seconds())
+	case d < time.Hour:
+		d = d.Round(time.Second)
+		return fmt.Sprintf("%dm%02ds", d/time.Minute, d%time.Minute/time.Second)
+	}
+	d = d.Round(time.Second)
+	return fmt.Sprintf("%dh%02dm%02ds", d/time.Hour, d%time.Hour/time.Minute, d%time.Minute/time.Second)
+}
+
+// onChange is the -on-change command, run after each write of the output.
+var onChange string
+
+// summary is the report written by -summary-json.
+type summary struct {
+	Added           []string          `json:"added"`
+	Modified        []string          `json:"modified"`
+	Removed         []string          `json:"removed"`
+	Renamed         []incmd5.Rename   `json:"renamed"`
+	Unstable        []string          `json:"unstable"`
+	SizeOnly        []string          `json:"size_changed_mtime_kept"`
+	SkippedBySize   []string          `json:"skipped_by_size"`
+	Deferred        []string          `json:"deferred"`
+	UnreadableDirs  []string          `json:"unreadable_dirs"`
+	HardLinks       []incmd5.HardLink `json:"hard_links"`
+	EmptyFiles      int               `json:"empty_files"`
+	Stats           *incmd5.HashStats `json:"stats,omitempty"`
+	Counts          summaryCounts     `json:"counts"`
+	BytesHashed     int64             `json:"bytes_hashed"`
+	BytesSkipped    int64             `json:"bytes_skipped"`
+	BytesResumed    int64             `json:"bytes_resumed"`
+	DurationSeconds float64           `json:"duration_seconds"`
+}
+
+type summaryCounts struct {
+	Added    int `json:"added"`
+	Modified int `json:"modified"`
+	Removed  int `json:"removed"`
+	Renamed  int `json:"renamed"`
+	Entries  int `json:"entries"`
+}
+
 func main() {
 	totalStart := time.Now()
-	var dir, output string
-	flag.StringVar(&dir, "dir", ".", "Directory to process")
-	flag.StringVar(&output, "output", "md5sums.txt", "Output file path")
+	var summaryPath, reportFormat, reportPath, changedPath, filesFrom, dupesPath, exts, baselinePath, exportPath, lineEnding, signKey, verifyKey string
+	var maxDepth int
+	bufferSize := byteSize(incmd5.DefaultBufferSize)
+	var maxFileSize, minFileSize byteSize
+	chunkMinSize := byteSize(incmd5.DefaultChunkMinSize)
+	var verify, compareWithVerify, normalize, compare, watch, progress, quiet, verbose, findDupes bool
+	var dirs, excludes, includes stringList
+	log.SetOutput(stderr)
+	scanner := &incmd5.Scanner{Logger: log.Default()}
+	flag.Var(&dirs, "dir", "Directory to process, repeatable for directories that do not overlap to share one output, a single file to hash alone, or - to hash stdin (default \".\")")
+	flag.StringVar(&scanner.Output, "output", "md5sums.txt", "Output file path, - to list the checksums on stdout (every file is hashed unless -db keeps them), a directory ending in .d to shard it by top-level directory, or with -per-dir the name of the file in each directory")
+	flag.StringVar(&scanner.Reference, "reference", "", "Read the previous checksums from this file or http(s) URL instead of the output, which is still written; -verify checks the tree against it")
+	flag.DurationVar(&scanner.FetchTimeout, "fetch-timeout", incmd5.DefaultFetchTimeout, "How long to wait for a -reference or -output URL to download")
+	flag.BoolVar(&scanner.NulTerminated, "z", false, "End each line of a text, BSD or SFV output with NUL instead of newline, like md5sum -z, so any file name is written as it is")
+	flag.BoolVar(&scanner.BinaryMarker, "binary", true, "Mark text entries as binary, \"<digest> *<path>\" like md5sum -b; -binary=false writes the text-mode \"<digest>  <path>\". md5sum -c accepts both, and so does reading")
+	flag.StringVar(&lineEnding, "line-ending", "lf", "Line ending of a text, BSD or SFV output: lf, or crlf for Windows tools; either is read")
+	flag.BoolVar(&scanner.HashEmptyAsConstant, "hash-empty-as-constant", false, "Record files that stat as empty with the digest of no input without opening them; wrong for pseudo-files that report size 0")
+	flag.BoolVar(&scanner.EmptyDirs, "dir-manifest", false, "Also record empty directories, as entries ending in / with an all-zero digest, so -verify reports one that disappeared")
+	flag.BoolVar(&scanner.DeleteEmpty, "delete-output-on-empty", false, "Delete the output instead of keeping an empty file when no entries are left")
+	flag.BoolVar(&scanner.VerifyOutput, "verify-output", false, "Read the output back after writing it and exit 1 unless it holds exactly the entries written")
+	flag.BoolVar(&scanner.Stream, "stream", false, "Write a text, BSD or SFV output through sorted temporary files instead of building it in memory; for very large trees")
+	flag.StringVar(&scanner.StripPrefix, "strip-prefix", "", "Remove this leading directory from every stored path; a file outside it is an error. -verify puts it back")
+	flag.StringVar(&scanner.AddPrefix, "add-prefix", "", "Prepend this directory to every stored path, after -strip-prefix; -verify removes it")
+	flag.BoolVar(&scanner.HomeRelative, "home-relative", false, "Store paths below your home directory as ~/path, so the output verifies on machines with other home directories; other directories keep relative paths")
+	flag.StringVar(&scanner.Database, "db", "", "Keep the checksums in this SQLite database instead of the -output file, looking files up as they are reached; for very large trees")
+	flag.StringVar(&exportPath, "export", "", "Write the entries of the -db database to this checksum file, in -format or the format its name implies, and exit")
+	flag.BoolVar(&scanner.PerDir, "per-dir", false, "Keep a checksum file in every directory listing its own files, instead of one file for the tree")
+	flag.StringVar(&scanner.Algorithm, "algo", "", "Hash algorithm: md5, sha1, sha256, sha512, crc32, or the faster xxhash64 or blake3; several joined by commas, such as md5,sha256, are computed in one pass into columns (default: crc32 for the sfv format, otherwise md5)")
+	flag.StringVar(&scanner.Format, "format", "", "Output format: text, json, bsd or sfv (default: json or sfv for .json or .sfv outputs, otherwise text)")
+	flag.IntVar(&scanner.Jobs, "jobs", runtime.NumCPU(), "Number of files to hash concurrently")
+	flag.IntVar(&scanner.QueueSize, "workers-queue-size", 0, "Files the walk may queue for the workers before it waits for them; 0 means twice -jobs")
+	flag.IntVar(&scanner.IOThreads, "threads-io", 0, "Maximum files read at once, independent of -jobs; 0 means one per job. Use 1 on spinning disks, 0 on SSDs")
+	flag.IntVar(&scanner.WalkJobs, "walk-jobs", 0, "Directories read at once ahead of the walk; try 8 or more for trees with very many directories on SSDs. 0 or 1 reads one at a time")
+	flag.Var(&bufferSize, "buffer-size", "Read buffer per worker in bytes, with an optional K, M or G suffix")
+	flag.IntVar(&scanner.Retries, "retries", 0, "Read a file up to this many more times after a transient error, such as a stale NFS handle")
+	flag.DurationVar(&scanner.RetryDelay, "retry-delay", incmd5.DefaultRetryDelay, "Wait before the first retry, doubled for each further one")
+	flag.BoolVar(&scanner.Mmap, "mmap", false, "Memory-map files of 64 MiB or more instead of reading them; faster on fast storage, but a file truncated mid-hash crashes the run")
+	flag.BoolVar(&verify, "verify", false, "Verify files against the existing output instead of updating it")
+	flag.BoolVar(&compareWithVerify, "compare-with-verify", false, "Like -verify, but also fail on files on disk that the output does not list, to reconcile a restored backup with its manifest in both directions")
+	flag.StringVar(&signKey, "sign-key", "", "Sign the output with the Ed25519 private key in this PEM file whenever it is written, into the output name plus .sig")
+	flag.StringVar(&verifyKey, "verify-key", "", "With -verify, first check the output's .sig signature against the Ed25519 public key in this PEM file")
+	flag.BoolVar(&scanner.TouchUnchanged, "touch-unchanged", false, "With -verify, set hashed_at of every entry that matches to when it was checked and rewrite the output (JSON format only); the files themselves are not touched")
+	flag.Float64Var(&scanner.VerifySample, "verify-sample", 0, "Verify only this percentage of the entries, picked at random, as a spot check; implies -verify and lists the entries picked with -verbose")
+	flag.Int64Var(&scanner.SampleSeed, "verify-seed", 0, "Seed for picking the -verify-sample entries, to repeat a sample; 0 picks and logs a random one")
+	flag.StringVar(&scanner.VerifyCheckpoint, "verify-checkpoint", "", "With -verify, record confirmed entries in this file and skip them when an interrupted run is restarted; deleted once a run completes")
+	flag.BoolVar(&normalize, "normalize", false, "Sort, de-duplicate and rewrite the existing output in canonical form without hashing; exits 3 if it changed")
+	flag.BoolVar(&compare, "compare", false, "Compare the two checksum files given as arguments, listing added, modified and removed paths on stdout, without scanning; exits 5 if they differ")
+	flag.BoolVar(&watch, "watch", false, "After the scan, keep running and update the output as files change until interrupted")
+	flag.BoolVar(&scanner.NoPrune, "no-prune", false, "Keep entries for files that no longer exist")
+	flag.BoolVar(&scanner.Force, "force", false, "Rehash every file, ignoring stored sizes, modtimes and the last run time")
+	flag.BoolVar(&scanner.MetadataOnly, "metadata-only", false, "Digest each file's path, size and modtime instead of its contents; fast but blind to silent content changes (algorithm \"metadata\")")
+	flag.BoolVar(&scanner.Archives, "archives", false, "Also hash each member of .zip, .tar, .tar.gz and .tgz files, keyed as archive.zip!member/path")
+	flag.BoolVar(&scanner.CaseInsensitive, "case-insensitive", false, "Treat paths differing only in case as one file, as on Windows and macOS; warns about such collisions")
+	flag.BoolVar(&scanner.DetectRenames, "detect-renames", false, "Report added files with the checksum of a removed entry as renames")
+	flag.BoolVar(&scanner.WriteHeader, "header", false, "Record the tool version, write time and scanned directories as comment lines at the top of the output")
+	flag.BoolVar(&scanner.StableOrder, "stable-order", false, "Keep the existing line order of a text or BSD output and append new entries, instead of sorting")
+	flag.BoolVar(&scanner.AllowCorrupt, "allow-corrupt", false, "Proceed when the output or baseline has unparsable lines, keeping the entries that could be read; the rest are dropped when the output is rewritten")
+	flag.IntVar(&scanner.FlushEvery, "flush-every", 0, "Save the entries so far to the output after every N files hashed, so a killed run keeps its work; 0 disables")
+	flag.DurationVar(&scanner.FlushInterval, "flush-interval", 0, "Save the entries so far to the output at least this often, such as 5m; 0 disables")
+	flag.BoolVar(&scanner.FailOnError, "fail-on-error", false, "Exit 1 without updating the output or timestamp if any file cannot be read")
+	flag.BoolVar(&scanner.FailFast, "fail-fast", false, "Like -fail-on-error, but stop at the first file or directory that cannot be read instead of hashing the rest and listing every failure")
+	flag.DurationVar(&scanner.RehashOlderThan, "rehash-older-than", 0, "Rehash files whose entry was hashed longer ago than this, such as 720h, even if unchanged (JSON format only)")
+	flag.BoolVar(&scanner.ChunkIndex, "chunk-index", false, "Keep an index of content-defined chunks for large files, so that a file changed towards its end is hashed only from its first changed chunk on; every byte is still read (JSON format only, not with blake3)")
+	flag.Var(&chunkMinSize, "chunk-min-size", "Size from which -chunk-index indexes a file, such as 1G")
+	flag.Var(sinceTime{&scanner.Since}, "since", "Rehash only files modified after this RFC 3339 time or duration ago, such as 24h, instead of since the last run; the timestamp file is left untouched")
+	flag.StringVar(&scanner.TimestampFile, "timestamp-file", "", "Path of the last-run marker file (default: .md5sum-timestamp inside each directory)")
+	flag.BoolVar(&scanner.NoTimestamp, "no-timestamp", false, "Neither read nor write the last-run marker file; slower, since files without a stored size and modtime are always rehashed")
+	flag.BoolVar(&scanner.FollowSymlinks, "follow-symlinks", false, "Hash symlink targets and descend into symlinked directories instead of skipping symlinks")
+	flag.Var(&maxFileSize, "max-file-size", "Skip files larger than this many bytes, with an optional K, M or G suffix; they are listed in -summary-json")
+	flag.DurationVar(&scanner.MinAge, "min-age", 0, "Defer files modified less than this long ago, such as 10s, to a later run so a file still being written is not hashed; they are listed in -summary-json")
+	flag.Var(&minFileSize, "min-file-size", "Skip files smaller than this many bytes, with an optional K, M or G suffix; they are listed in -summary-json")
+	flag.IntVar(&maxDepth, "max-depth", -1, "Descend at most this many directories below each -dir; 0 hashes only its own files, -1 is unlimited")
+	flag.StringVar(&filesFrom, "files-from", "", "Hash only the newline-separated paths read from this file (- for stdin) instead of walking")
+	flag.StringVar(&scanner.GitRange, "git-range", "", "Hash only the files git diff lists as changed in this range, such as main..HEAD, pruning those it deleted; requires a single -dir in a git work tree")
+	flag.BoolVar(&scanner.DryRun, "dry-run", false, "Report what would change without writing the output or timestamp file")
+	flag.BoolVar(&scanner.Stats, "stats", false, "Time every file hashed and report latency and throughput percentiles and the slowest files, also in -summary-json")
+	flag.BoolVar(&progress, "progress", false, "Show a progress bar with an ETA on a terminal, otherwise print a periodic status line with files and bytes hashed")
+	flag.BoolVar(&quiet, "quiet", false, "Log errors only")
+	flag.BoolVar(&verbose, "verbose", false, "Also log every file checked or skipped")
+	flag.BoolVar(&humanReadable, "human", false, "Log sizes and durations in units, such as 1.2 GiB and 3m04s, instead of byte counts and Go durations; -summary-json stays raw")
+	flag.StringVar(&baselinePath, "baseline", "", "Also report how the scanned tree differs from this checksum file, which is left untouched")
+	flag.StringVar(&onChange, "on-change", "", "Shell command to run after the output is rewritten, given the -changed-list paths on stdin and INCMD5_OUTPUT, INCMD5_ADDED, INCMD5_MODIFIED and INCMD5_REMOVED in its environment; its exit status is logged")
+	flag.StringVar(&changedPath, "changed-list", "", "Write the paths added or modified by this run, one per line, to this file (- for stdout)")
+	flag.StringVar(&summaryPath, "summary-json", "", "Write a JSON report of added, modified and removed paths to this file")
+	flag.StringVar(&reportFormat, "report-format", "text", "Format of the summary of a scan: text, logged as usual, or json, the -summary-json report, or csv, a header and a row of counts, bytes and seconds, written to -report")
+	flag.StringVar(&reportPath, "report", "-", "File a json or csv -report-format is written to, - for stdout, which then carries nothing else")
+	flag.BoolVar(&findDupes, "find-dupes", false, "List groups of files with identical checksums after the scan")
+	flag.StringVar(&dupesPath, "dupes-file", "", "Write the -find-dupes groups to this file instead of stdout")
+	flag.StringVar(&scanner.IgnoreFile, "ignore-file", incmd5.DefaultIgnoreFile, "Name of the gitignore-style file read from each directory; empty disables")
+	flag.Var(&excludes, "exclude", "Glob of paths to skip, repeatable; supports ** and always wins over includes")
+	flag.StringVar(&exts, "ext", "", "Comma-separated extensions to hash, such as iso,img,zip; others are skipped")
+	flag.Var(&includes, "include", "Glob of files to hash, repeatable; when given, other files are skipped")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage of %s:\n", os.Args[0])
+		flag.PrintDefaults()
+		fmt.Fprint(flag.CommandLine.Output(), exitStatusHelp)
+	}
 	flag.Parse()
+	scanner.Excludes = excludes
+	scanner.Includes = includes
+	if exts != "" {
+		for _, ext := range strings.Split(exts, ",") {
+			if ext = strings.TrimSpace(ext); ext != "" {
+				scanner.Extensions = append(scanner.Extensions, ext)
+			}
+		}
+	}
+	switch strings.ToLower(lineEnding) {
+	case "lf":
+	case "crlf":
+		scanner.CRLF = true
+	default:
+		log.Fatalf("Invalid line ending: %s", lineEnding)
+	}
+	scanner.MaxDepth = maxDepth + 1
+	scanner.BufferSize = int(bufferSize)
+	scanner.MaxFileSize = int64(maxFileSize)
+	scanner.MinFileSize = int64(minFileSize)
+	scanner.ChunkMinSize = int64(chunkMinSize)
+	if len(dirs) == 0 {
+		dirs = stringList{"."}
+	}
 
-	targetDir, err := filepath.Abs(dir)
-	if err != nil {
-		log.Fatalf("Invalid directory: %v", err)
+	switch {
+	case quiet && verbose:
+		log.Fatal("-quiet and -verbose are mutually exclusive")
+	case quiet:
+		logLevel = incmd5.LogQuiet
+	case verbose:
+		logLevel = incmd5.LogVerbose
+	}
+	scanner.LogLevel = logLevel
+
+	if scanner.Jobs < 1 {
+		log.Fatalf("Invalid job count: %d", scanner.Jobs)
+	}
+	if scanner.Retries < 0 {
+		log.Fatalf("Invalid retry count: %d", scanner.Retries)
 	}
-	if _, err := os.Stat(targetDir); os.IsNotExist(err) {
-		log.Fatalf("Directory does not exist: %s", targetDir)
+	if scanner.FlushEvery < 0 {
+		log.Fatalf("Invalid flush count: %d", scanner.FlushEvery)
+	}
+	if scanner.QueueSize < 0 {
+		log.Fatalf("Invalid queue size: %d", scanner.QueueSize)
+	}
+	if scanner.WalkJobs < 0 {
+		log.Fatalf("Invalid walk job count: %d", scanner.WalkJobs)
+	}
+	if scanner.IOThreads < 0 {
+		log.Fatalf("Invalid I/O thread count: %d", scanner.IOThreads)
+	}
+	if maxDepth < -1 {
+		log.Fatalf("Invalid max depth: %d", maxDepth)
 	}
 
-	outputPath, err := filepath.Abs(output)
-	if err != nil {
-		log.Fatalf("Invalid output path: %v", err)
+	if slices.Contains(dirs, "-") {
+		if len(dirs) != 1 || filesFrom != "" {
+			log.Fatal("-dir - cannot be combined with other directories or -files-from")
+		}
+		sum, err := scanner.HashReader(os.Stdin)
+		if err != nil {
+			log.Fatalf("Failed to hash stdin: %v", err)
+		}
+		fmt.Printf("%s  -\n", sum)
+		return
 	}
 
-	existingChecksums := readChecksums(outputPath)
-	newChecksums := make(map[string]string)
-	for k, v := range existingChecksums {
-		newChecksums[k] = v
+	if signKey != "" {
+		key, err := incmd5.ReadSigningKey(signKey)
+		if err != nil {
+			log.Fatalf("Failed to read signing key: %v", err)
+		}
+		scanner.SignKey = key
+	}
+	if verifyKey != "" {
+		key, err := incmd5.ReadVerifyingKey(verifyKey)
+		if err != nil {
+			log.Fatalf("Failed to read verifying key: %v", err)
+		}
+		scanner.VerifyKey = key
 	}
 
-	timestampPath := filepath.Join(targetDir, MD5TimestampFile)
-	lastRun := getLastRunTime(timestampPath)
+	if incmd5.IsURL(scanner.Output) {
+		if !verify && !compareWithVerify {
+			log.Fatal("-output can only be a URL with -verify; use -reference to scan against a remote manifest")
+		}
+		if scanner.Reference != "" {
+			log.Fatal("-output is a URL and -reference is set; give only one")
+		}
+		scanner.Reference = scanner.Output
+	}
+
+	if filesFrom != "" && scanner.GitRange != "" {
+		log.Fatal("-files-from and -git-range are mutually exclusive")
+	}
+	if filesFrom != "" {
+		files, err := readFileList(filesFrom)
+		if err != nil {
+			log.Fatalf("Failed to read file list: %v", err)
+		}
+		scanner.Files = files
+	}
 
-	changed := false
-	neededUpdate := false
-	processedCount := 0
-	processingStart := time.Now()
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-	buf := make([]byte, 8192)
+	stopProgress := func() {}
+	if progress {
+		scanner.Progress = &incmd5.Progress{}
+		stopProgress = reportProgress(scanner.Progress, progressInterval)
+	}
 
-	filepath.Walk(targetDir, func(path string, info os.FileInfo, err error) error {
-		if err != nil || info.IsDir() {
-			return nil
+	if compare {
+		if flag.NArg() != 2 {
+			log.Fatal("-compare takes two checksum files")
 		}
+		os.Exit(runCompare(flag.Arg(0), flag.Arg(1), scanner.AllowCorrupt))
+	}
+	if scanner.Output == incmd5.StdoutPath && (normalize || changedPath == "-") {
+		log.Fatal("-output - cannot be combined with -normalize or -changed-list -")
+	}
+	switch reportFormat {
+	case "text":
+	case "json", "csv":
+		if reportPath == "-" && (scanner.Output == incmd5.StdoutPath || changedPath == "-" || (findDupes && dupesPath == "")) {
+			log.Fatal("-report-format writes to stdout, which -output -, -changed-list - and -find-dupes without -dupes-file also write to; give -report a file")
+		}
+	default:
+		log.Fatalf("Invalid report format: %s", reportFormat)
+	}
+	if exportPath != "" {
+		if scanner.Database == "" {
+			log.Fatal("-export requires -db")
+		}
+		if err := incmd5.ExportDatabase(scanner.Database, exportPath, scanner.Format); err != nil {
+			log.Fatalf("Failed to export database: %v", err)
+		}
+		return
+	}
+	if scanner.Database != "" && (normalize || findDupes || dupesPath != "" || baselinePath != "") {
+		log.Fatal("-db cannot be combined with -normalize, -find-dupes, -dupes-file or -baseline")
+	}
+	if scanner.Stream && (findDupes || dupesPath != "" || baselinePath != "") {
+		log.Fatal("-stream cannot be combined with -find-dupes, -dupes-file or -baseline")
+	}
 
-		relPath, err := filepath.Rel(targetDir, path)
+	if scanner.VerifySample != 0 {
+		if scanner.VerifySample < 0 || scanner.VerifySample > 100 {
+			log.Fatal("-verify-sample must be a percentage above 0 and at most 100")
+		}
+		if compareWithVerify {
+			log.Fatal("-verify-sample cannot be combined with -compare-with-verify, which needs every entry checked")
+		}
+		verify = true
+	}
+	if verify || compareWithVerify {
+		os.Exit(runVerify(ctx, scanner, dirs, compareWithVerify, stopProgress))
+	}
+	if normalize {
+		changed, err := scanner.Normalize()
 		if err != nil {
-			log.Printf("Relative path error: %s - %v", path, err)
-			return nil
+			fatal(err)
+		}
+		if changed {
+			os.Exit(exitChanged)
+		}
+		return
+	}
+	if watch {
+		if len(dirs) != 1 || scanner.Files != nil || scanner.GitRange != "" || scanner.DryRun {
+			log.Fatal("-watch requires a single -dir and cannot be combined with -files-from, -git-range or -dry-run")
 		}
+		err := scanner.WatchContext(ctx, dirs[0], watchDebounce, reportWatch)
+		stopProgress()
+		if err != nil && !errors.Is(err, context.Canceled) {
+			log.Fatal(err)
+		}
+		return
+	}
 
-		log.Printf("Checking %s", relPath)
+	res, err := scanner.ScanDirsContext(ctx, dirs)
+	stopProgress()
+	if len(res.Failed) > 0 {
+		log.Printf("Could not read %d files:", len(res.Failed))
+		for _, fe := range res.Failed {
+			log.Printf("  %v", fe)
+		}
+	}
+	interrupted := errors.Is(err, context.Canceled)
+	if err != nil && !interrupted {
+		fatal(err)
+	}
+	if scanner.Database != "" && scanner.Output == incmd5.StdoutPath && !scanner.DryRun {
+		if err := incmd5.ExportDatabase(scanner.Database, incmd5.StdoutPath, scanner.Format); err != nil {
+			log.Fatalf("Failed to write the listing: %v", err)
+		}
+	}
+	if changedPath != "" {
+		if err := writeChangedList(changedPath, res); err != nil {
+			log.Fatalf("Failed to write changed list: %v", err)
+		}
+	}
+	if summaryPath != "" {
+		if err := writeSummary(summaryPath, res); err != nil {
+			log.Fatalf("Failed to write summary: %v", err)
+		}
+	}
+	if reportFormat != "text" {
+		if err := writeReport(reportPath, reportFormat, res); err != nil {
+			log.Fatalf("Failed to write report: %v", err)
+		}
+	}
+	differs := false
+	if baselinePath != "" && !interrupted {
+		c, err := compareBaseline(baselinePath, res, scanner.AllowCorrupt)
+		if err != nil {
+			fatal(fmt.Errorf("failed to compare with baseline: %w", err))
+		}
+		differs = !c.Equal()
+	}
+	if findDupes || dupesPath != "" {
+		if err := writeDuplicates(dupesPath, res.Checksums); err != nil {
+			log.Fatalf("Failed to write duplicates: %v", err)
+		}
+	}
 
-		if strings.HasSuffix(relPath, MD5TimestampFile) {
-			log.Println("SKIPPING")
-			return nil
+	if scanner.DryRun {
+		for _, path := range res.Added {
+			infof("Would add %s", path)
+		}
+		for _, path := range res.Modified {
+			infof("Would update %s", path)
+		}
+		for _, path := range res.Removed {
+			infof("Would prune %s", path)
 		}
+		for _, rn := range res.Renamed {
+			infof("Would rename %s -> %s", rn.From, rn.To)
+		}
+		infof("Dry run: %d added, %d modified, %d removed, %d renamed | Entries: %d | Changes pending: %t",
+			len(res.Added), len(res.Modified), len(res.Removed), len(res.Renamed), res.Entries, res.Changed)
+	}
 
-		needsUpdate := info.ModTime().After(lastRun) || !fileExistsInChecksums(relPath, existingChecksums)
-		if needsUpdate {
-			sum, err := fileMD5(path, buf)
-			if err != nil {
-				log.Printf("Checksum failed: %s - %v", path, err)
-				return nil
-			}
+	if len(res.SkippedBySize) > 0 {
+		infof("Skipped %d files outside the size limits", len(res.SkippedBySize))
+	}
+	if len(res.Deferred) > 0 {
+		infof("Deferred %d files modified within -min-age to a later run", len(res.Deferred))
+	}
+	if len(res.HardLinks) > 0 {
+		infof("Reused the checksum of %d hard links instead of rehashing them", len(res.HardLinks))
+	}
+	reportStats(res.Stats)
+	if !res.Written {
+		infof("Total duration: %s | %s", formatDuration(time.Since(totalStart)), volume(res))
+		os.Exit(scanStatus(res, interrupted, differs))
+	}
 
-			if existingChecksums[relPath] != sum {
-				changed = true
-				newChecksums[relPath] = sum
-				processedCount++
-			}
-			neededUpdate = true
+	// Print updated checksums file contents, unless stdout carries the
+	// changed list or the report.
+	if logLevel != incmd5.LogQuiet && !scanner.PerDir && scanner.Database == "" && changedPath != "-" && res.Output != incmd5.StdoutPath && !incmd5.IsSharded(res.Output) &&
+		(reportFormat == "text" || reportPath != "-") {
+		log.Println("\nUpdated checksums:")
+		if err := printOutput(res.Output); err != nil {
+			log.Printf("Failed to read output file: %v", err)
 		}
-		return nil
-	})
+	}
 
-	processingDuration := time.Since(processingStart)
+	infof("\nProcessed %d files in %s | %s", res.Processed, formatDuration(res.Duration), volume(res))
+	runOnChange(res)
+	infof("Total duration: %s | Entries: %d", formatDuration(time.Since(totalStart)), res.Entries)
+	os.Exit(scanStatus(res, interrupted, differs))
+}
 
-	if !changed && mapsEqual(existingChecksums, newChecksums) {
-		log.Printf("No changes detected. Existing file preserved: %s", outputPath)
-		log.Printf("Total duration: %v", time.Since(totalStart))
+// runOnChange runs the -on-change command, if any, for the scan that wrote
+// res, and logs how it exited. A failing command does not change the exit
+// status of the scan.
+func runOnChange(res incmd5.Result) {
+	if onChange == "" {
+		return
+	}
+	shell, arg := "sh", "-c"
+	if runtime.GOOS == "windows" {
+		shell, arg = "cmd", "/C"
+	}
+	cmd := exec.Command(shell, arg, onChange)
+	cmd.Stdin = strings.NewReader(changedList(res))
+	// Stdout may carry a listing or a report, so the command writes to
+	// stderr.
+	cmd.Stdout, cmd.Stderr = stderr, stderr
+	cmd.Env = append(os.Environ(),
+		"INCMD5_OUTPUT="+res.Output,
+		"INCMD5_ADDED="+strconv.Itoa(len(res.Added)),
+		"INCMD5_MODIFIED="+strconv.Itoa(len(res.Modified)),
+		"INCMD5_REMOVED="+strconv.Itoa(len(res.Removed)),
+	)
+	err := cmd.Run()
+	var exitErr *exec.ExitError
+	switch {
+	case errors.As(err, &exitErr):
+		log.Printf("-on-change command exited with status %d", exitErr.ExitCode())
+	case err != nil:
+		log.Printf("Failed to run the -on-change command: %v", err)
+	default:
+		infof("-on-change command exited with status 0")
+	}
+}
 
-		if neededUpdate {
-			log.Printf("Updated last run: %s", timestampPath)
-			updateLastRun(timestampPath)
-		}
+// reportStats logs the -stats summary.
+func reportStats(stats *incmd5.HashStats) {
+	if stats == nil {
 		return
 	}
+	infof("Hash latency over %d files | p50: %s | p95: %s | p99: %s | max: %s",
+		stats.Files, formatDuration(stats.P50), formatDuration(stats.P95), formatDuration(stats.P99), formatDuration(stats.Max))
+	infof("Throughput per file | p10: %s | p50: %s | p90: %s",
+		formatRate(stats.ThroughputP10), formatRate(stats.ThroughputP50), formatRate(stats.ThroughputP90))
+	for _, t := range stats.Slowest {
+		infof("  %s  %s  %s", formatDuration(t.Duration), formatBytes(t.Bytes), t.Path)
+	}
+}
 
-	if err := writeChecksums(outputPath, newChecksums); err != nil {
-		log.Fatal(err)
+// volume describes the data hashed and skipped by a scan.
+func volume(res incmd5.Result) string {
+	v := fmt.Sprintf("Hashed: %s at %s | Skipped: %s unchanged",
+		formatBytes(res.BytesHashed), formatRate(float64(res.BytesHashed)/res.Duration.Seconds()), formatBytes(res.BytesSkipped))
+	if res.BytesResumed > 0 {
+		v += fmt.Sprintf(" | Resumed: %s from chunk indexes", formatBytes(res.BytesResumed))
 	}
-	updateLastRun(timestampPath)
+	return v
+}
 
-	// Print updated checksums file contents
-	log.Println("\nUpdated checksums:")
-	if content, err := os.ReadFile(outputPath); err == nil {
-		fmt.Print(string(content))
-	} else {
-		log.Printf("Failed to read output file: %v", err)
+// reportWatch logs the outcome of each scan made by -watch.
+func reportWatch(res incmd5.Result, err error) {
+	if err != nil && !errors.Is(err, context.Canceled) {
+		log.Print(err)
+	}
+	for _, fe := range res.Failed {
+		log.Printf("Could not read %v", fe)
+	}
+	if res.Written {
+		infof("Updated %s: %d added, %d modified, %d removed | Entries: %d",
+			res.Output, len(res.Added), len(res.Modified), len(res.Removed), res.Entries)
+		runOnChange(res)
 	}
+}
 
-	log.Printf("\nProcessed %d files in %v", processedCount, processingDuration)
-	log.Printf("Total duration: %v | Entries: %d", time.Since(totalStart), len(newChecksums))
+// scanStatus returns the exit status for a scan ending with res. differs
+// reports a difference from the baseline.
+func scanStatus(res incmd5.Result, interrupted, differs bool) int {
+	switch {
+	case interrupted:
+		return exitInterrupted
+	case len(res.Failed) > 0:
+		return exitPartial
+	case differs:
+		return exitBaseline
+	case res.Changed:
+		return exitChanged
+	}
+	return 0
 }
 
-func fileMD5(path string, buf []byte) (string, error) {
+// printOutput copies the checksum file at path to stdout, decompressing it
+// if it is gzipped.
+func printOutput(path string) error {
 	file, err := os.Open(path)
 	if err != nil {
-		return "", err
+		return err
 	}
 	defer file.Close()
 
-	hash := md5.New()
-	if _, err := io.CopyBuffer(hash, file, buf); err != nil {
-		return "", err
+	var r io.Reader = file
+	if strings.EqualFold(filepath.Ext(path), ".gz") {
+		gz, err := gzip.NewReader(file)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		r = gz
 	}
-	return hex.EncodeToString(hash.Sum(nil)), nil
+	_, err = io.Copy(os.Stdout, r)
+	return err
 }
 
-func readChecksums(path string) map[string]string {
-	checksums := make(map[string]string)
-	file, err := os.Open(path)
-	if err != nil {
-		return checksums
+// reportProgress logs a status line for p every interval until the
+// returned function is called, which logs a final line and stops. When
+// stderr is a terminal, a progress bar is redrawn in place instead.
+func reportProgress(p *incmd5.Progress, interval time.Duration) func() {
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	var lastBytes int64
+	start := time.Now()
+	lastTime := start
+	bar := term.IsTerminal(int(os.Stderr.Fd()))
+	status := func(now time.Time, final bool) {
+		bytes := p.Bytes.Load()
+		rate := float64(bytes-lastBytes) / now.Sub(lastTime).Seconds()
+		lastBytes, lastTime = bytes, now
+		if bar {
+			drawProgressBar(p, bytes, rate, now.Sub(start), final)
+			return
+		}
+		log.Printf("Progress: %d hashed, %d skipped, %s hashed, %s",
+			p.Hashed.Load(), p.Skipped.Load(), formatBytes(bytes), formatRate(rate))
 	}
-	defer file.Close()
 
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		line := strings.TrimSpace(scanner.Text())
-		parts := strings.SplitN(line, "  ", 2)
-		if len(parts) == 2 {
-			checksums[parts[1]] = parts[0]
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case now := <-ticker.C:
+				status(now, false)
+			case <-done:
+				status(time.Now(), true)
+				return
+			}
 		}
+	}()
+	return func() {
+		close(done)
+		<-stopped
 	}
-	return checksums
 }
 
-func writeChecksums(path string, checksums map[string]string) error {
-	tmpPath := path + ".tmp"
-	file, err := os.Create(tmpPath)
-	if err != nil {
-		return err
+// progressBarWidth is the number of cells in the -progress bar.
+const progressBarWidth = 30
+
+// drawProgressBar redraws the -progress bar for p on stderr, given the
+// bytes hashed so far, the current throughput in bytes per second and the
+// time since the run started, and ends the line if final. The share done
+// is by bytes, or by files when no sizes are known, and the ETA assumes
+// the average throughput so far. Until the walk has finished the total is still
+// growing, so only what has been found is shown.
+func drawProgressBar(p *incmd5.Progress, bytes int64, rate float64, elapsed time.Duration, final bool) {
+	hashed, queued := p.Hashed.Load(), p.Queued.Load()
+	total := p.QueuedBytes.Load()
+	var line string
+	if !p.Walked.Load() && !final {
+		line = fmt.Sprintf("%d of %d files found hashed, %d skipped | %s of %s | %s",
+			hashed, queued, p.Skipped.Load(), formatBytes(bytes), formatBytes(total), formatRate(rate))
+	} else {
+		done := 1.0
+		switch {
+		case total > 0:
+			done = min(float64(bytes)/float64(total), 1)
+		case queued > 0:
+			done = min(float64(hashed)/float64(queued), 1)
+		}
+		eta := "--"
+		if done > 0 && done < 1 {
+			eta = formatDuration(time.Duration(float64(elapsed) * (1 - done) / done).Round(time.Second))
+		}
+		filled := int(done * progressBarWidth)
+		line = fmt.Sprintf("[%s%s] %3.0f%% | %d/%d files | %s/%s | %s | ETA %s",
+			strings.Repeat("=", filled), strings.Repeat(" ", progressBarWidth-filled), done*100,
+			hashed, queued, formatBytes(bytes), formatBytes(total), formatRate(rate), eta)
 	}
-	defer file.Close()
+	stderr.drawBar(line, final)
+}
+
+// clearLine returns the cursor to the start of the terminal line and
+// erases it.
+const clearLine = "\r\x1b[K"
+
+// console serializes everything written to stderr: the log lines of the
+// scanner's goroutines and of main, and the -progress bar. log.Logger
+// writes each line with a single Write, which console passes on whole;
+// while a bar is shown it is cleared before the line and redrawn after
+// it, so that neither cuts into the other.
+type console struct {
+	mu  sync.Mutex
+	out io.Writer
+	// bar is the progress bar on the last line, or "" if none is shown.
+	bar string
+}
+
+// stderr is the console every log line goes through.
+var stderr = &console{out: os.Stderr}
 
-	paths := make([]string, 0, len(checksums))
-	for path := range checksums {
-		paths = append(paths, path)
+func (c *console) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.bar == "" {
+		return c.out.Write(p)
 	}
-	sort.Strings(paths)
+	line := make([]byte, 0, len(clearLine)+len(p)+len(c.bar))
+	line = append(append(append(line, clearLine...), p...), c.bar...)
+	if _, err := c.out.Write(line); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
 
-	for _, path := range paths {
-		if _, err := fmt.Fprintf(file, "%s  %s\n", checksums[path], path); err != nil {
-			return err
+// drawBar replaces the progress bar with line, or if final writes line as
+// the last state of the bar and ends it.
+func (c *console) drawBar(line string, final bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// Clear whatever is left of the previous, possibly longer, line.
+	if final {
+		fmt.Fprintf(c.out, "%s%s\n", clearLine, line)
+		c.bar = ""
+		return
+	}
+	fmt.Fprintf(c.out, "%s%s", clearLine, line)
+	c.bar = line
+}
+
+// readFileList reads newline-separated paths from the named file, or from
+// stdin if name is "-". Blank lines are ignored.
+func readFileList(name string) ([]string, error) {
+	in := os.Stdin
+	if name != "-" {
+		file, err := os.Open(name)
+		if err != nil {
+			return nil, err
 		}
+		defer file.Close()
+		in = file
 	}
 
-	return os.Rename(tmpPath, path)
+	files := []string{}
+	scanner := bufio.NewScanner(in)
+	for scanner.Scan() {
+		if line := strings.TrimSuffix(scanner.Text(), "\r"); line != "" {
+			files = append(files, line)
+		}
+	}
+	return files, scanner.Err()
 }
 
-func getLastRunTime(path string) time.Time {
-	info, err := os.Stat(path)
+// fatal logs err and exits with status 1, pointing at -allow-corrupt if a
+// checksum file could not be read.
+func fatal(err error) {
+	if errors.Is(err, incmd5.ErrManifestCorrupt) {
+		log.Fatalf("%v; refusing to continue. Repair or move it, or rerun with -allow-corrupt", err)
+	}
+	log.Fatal(err)
+}
+
+// compareBaseline logs how the scan result res differs from the checksum
+// file at path. A corrupt baseline is an error unless allowCorrupt is set.
+func compareBaseline(path string, res incmd5.Result, allowCorrupt bool) (incmd5.Comparison, error) {
+	if _, err := os.Stat(path); err != nil {
+		return incmd5.Comparison{}, err
+	}
+	baseline, header, err := incmd5.ReadChecksums(path)
 	if err != nil {
-		return time.Time{}
+		if !allowCorrupt {
+			return incmd5.Comparison{}, err
+		}
+		log.Printf("WARNING: %v; comparing the %d entries that could be read", err, len(baseline))
+	}
+	if header.Algorithm != res.Algorithm {
+		return incmd5.Comparison{}, fmt.Errorf("%s holds %s checksums, the scan used %s", path, header.Algorithm, res.Algorithm)
+	}
+
+	c := incmd5.Compare(baseline, res.Checksums)
+	for _, group := range []struct {
+		label string
+		paths []string
+	}{
+		{"DIFFERS", c.Differ},
+		{"NEW", c.Added},
+		{"GONE", c.Removed},
+	} {
+		for _, p := range group.paths {
+			log.Printf("%s %s", group.label, p)
+		}
 	}
-	return info.ModTime()
+	infof("Compared with %s | Differ: %d | New: %d | Gone: %d", path, len(c.Differ), len(c.Added), len(c.Removed))
+	return c, nil
 }
 
-func updateLastRun(path string) {
-	dir := filepath.Dir(path)
-	if err := os.MkdirAll(dir, 0755); err != nil {
+// runCompare lists on stdout how the checksum file at newPath differs from
+// the one at oldPath and returns the exit status.
+func runCompare(oldPath, newPath string, allowCorrupt bool) int {
+	var files [2]map[string]incmd5.Record
+	var algos [2]string
+	for i, path := range []string{oldPath, newPath} {
+		if _, err := os.Stat(path); err != nil {
+			log.Fatal(err)
+		}
+		checksums, header, err := incmd5.ReadChecksums(path)
+		if err != nil {
+			if !allowCorrupt {
+				fatal(err)
+			}
+			log.Printf("WARNING: %v; comparing the %d entries that could be read", err, len(checksums))
+		}
+		files[i], algos[i] = checksums, header.Algorithm
+	}
+	if algos[0] != algos[1] {
+		log.Fatalf("%s holds %s checksums, %s holds %s", oldPath, algos[0], newPath, algos[1])
+	}
+
+	c := incmd5.Compare(files[0], files[1])
+	out := bufio.NewWriter(os.Stdout)
+	for _, group := range []struct {
+		label string
+		paths []string
+	}{
+		{"added", c.Added},
+		{"modified", c.Differ},
+		{"removed", c.Removed},
+	} {
+		for _, p := range group.paths {
+			fmt.Fprintf(out, "%s %s\n", group.label, p)
+		}
+	}
+	if err := out.Flush(); err != nil {
 		log.Fatal(err)
 	}
+	infof("Compared %s with %s | Added: %d | Modified: %d | Removed: %d", newPath, oldPath, len(c.Added), len(c.Differ), len(c.Removed))
+	if !c.Equal() {
+		return exitBaseline
+	}
+	return 0
+}
 
-	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+// writeSummary writes the -summary-json report for res to path.
+func writeSummary(path string, res incmd5.Result) error {
+	data, err := json.MarshalIndent(newSummary(res), "", "  ")
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
-	file.Close()
-	now := time.Now()
-	if err := os.Chtimes(path, now, now); err != nil {
-		log.Fatal(err)
+	return os.WriteFile(path, append(data, '\n'), 0644)
+}
+
+// reportColumns heads the rows of the csv -report-format.
+var reportColumns = []string{"added", "modified", "removed", "renamed", "entries", "failed", "bytes_hashed", "bytes_skipped", "duration_seconds"}
+
+// writeReport writes the summary of res in format, json or csv, to path,
+// or to stdout if path is "-".
+func writeReport(path, format string, res incmd5.Result) error {
+	var b bytes.Buffer
+	if format == "json" {
+		data, err := json.MarshalIndent(newSummary(res), "", "  ")
+		if err != nil {
+			return err
+		}
+		b.Write(append(data, '\n'))
+	} else {
+		w := csv.NewWriter(&b)
+		w.Write(reportColumns)
+		w.Write([]string{
+			strconv.Itoa(len(res.Added)),
+			strconv.Itoa(len(res.Modified)),
+			strconv.Itoa(len(res.Removed)),
+			strconv.Itoa(len(res.Renamed)),
+			strconv.Itoa(res.Entries),
+			strconv.Itoa(len(res.Failed)),
+			strconv.FormatInt(res.BytesHashed, 10),
+			strconv.FormatInt(res.BytesSkipped, 10),
+			strconv.FormatFloat(res.Duration.Seconds(), 'f', -1, 64),
+		})
+		w.Flush()
+		if err := w.Error(); err != nil {
+			return err
+		}
 	}
+	if path == "-" {
+		_, err := os.Stdout.Write(b.Bytes())
+		return err
+	}
+	return os.WriteFile(path, b.Bytes(), 0644)
 }
 
-func mapsEqual(a, b map[string]string) bool {
-	if len(a) != len(b) {
-		return false
+// newSummary returns the -summary-json report for res.
+func newSummary(res incmd5.Result) summary {
+	return summary{
+		Added:          nonNil(res.Added),
+		Modified:       nonNil(res.Modified),
+		Removed:        nonNil(res.Removed),
+		Renamed:        nonNil(res.Renamed),
+		Unstable:       nonNil(res.Unstable),
+		SizeOnly:       nonNil(res.SizeOnly),
+		SkippedBySize:  nonNil(res.SkippedBySize),
+		Deferred:       nonNil(res.Deferred),
+		UnreadableDirs: nonNil(res.UnreadableDirs),
+		HardLinks:      nonNil(res.HardLinks),
+		EmptyFiles:     res.Empty,
+		Stats:          res.Stats,
+		Counts: summaryCounts{
+			Added:    len(res.Added),
+			Modified: len(res.Modified),
+			Removed:  len(res.Removed),
+			Renamed:  len(res.Renamed),
+			Entries:  res.Entries,
+		},
+		BytesHashed:     res.BytesHashed,
+		BytesSkipped:    res.BytesSkipped,
+		BytesResumed:    res.BytesResumed,
+		DurationSeconds: res.Duration.Seconds(),
 	}
-	for k, av := range a {
-		if bv, exists := b[k]; !exists || bv != av {
-			return false
+}
+
+// writeDuplicates writes each group of identical files as checksum lines
+// followed by a blank line, to path or to stdout if path is empty.
+func writeDuplicates(path string, checksums map[string]incmd5.Record) error {
+	var b strings.Builder
+	groups := incmd5.FindDuplicates(checksums)
+	for _, group := range groups {
+		for _, p := range group {
+			fmt.Fprintf(&b, "%s  %s\n", checksums[p].Hash, p)
 		}
+		b.WriteString("\n")
+	}
+	infof("Found %d groups of duplicate files", len(groups))
+
+	if path == "" {
+		_, err := os.Stdout.WriteString(b.String())
+		return err
+	}
+	return os.WriteFile(path, []byte(b.String()), 0644)
+}
+
+// writeChangedList writes the changedList of res to path, or to stdout if
+// path is "-". Nothing is written when nothing changed.
+func writeChangedList(path string, res incmd5.Result) error {
+	list := changedList(res)
+	if path == "-" {
+		_, err := os.Stdout.WriteString(list)
+		return err
 	}
-	return true
+	return os.WriteFile(path, []byte(list), 0644)
 }
 
-func fileExistsInChecksums(path string, checksums map[string]string) bool {
-	_, exists := checksums[path]
-	return exists
+// changedList returns the sorted paths that res added or modified,
+// including rename targets, one per line.
+func changedList(res incmd5.Result) string {
+	changed := slices.Concat(res.Added, res.Modified)
+	for _, rn := range res.Renamed {
+		changed = append(changed, rn.To)
+	}
+	slices.Sort(changed)
+	var b strings.Builder
+	for _, p := range changed {
+		b.WriteString(p)
+		b.WriteByte('\n')
+	}
+	return b.String()
+}
+
+// nonNil returns items, or an empty slice if it is nil, so that JSON
+// reports always contain arrays.
+func nonNil[T any](items []T) []T {
+	if items == nil {
+		return []T{}
+	}
+	return items
+}
+
+// runVerify reports the result of verifying dirs and returns the exit status.
+// With reconcile, unlisted files are discrepancies too. stopProgress is
+// called once verification finishes.
+func runVerify(ctx context.Context, scanner *incmd5.Scanner, dirs []string, reconcile bool, stopProgress func()) int {
+	res, err := scanner.VerifyDirsContext(ctx, dirs)
+	stopProgress()
+	if err != nil && !errors.Is(err, context.Canceled) {
+		fatal(err)
+	}
+
+	for _, group := range []struct {
+		label string
+		paths []string
+	}{
+		{"MISMATCH", res.Mismatched},
+		{"MISSING", res.Missing},
+		{"FAILED", res.Failed},
+		{"MODE", res.ModeChanged},
+	} {
+		for _, path := range group.paths {
+			log.Printf("%s %s", group.label, path)
+		}
+	}
+	for _, path := range res.Unlisted {
+		if reconcile {
+			log.Printf("UNLISTED %s", path)
+		} else {
+			infof("UNLISTED %s", path)
+		}
+	}
+
+	if res.Resumed > 0 {
+		infof("Skipped %d entries confirmed by an earlier run", res.Resumed)
+	}
+	if res.Sampled != nil {
+		if logLevel == incmd5.LogVerbose {
+			for _, path := range res.Sampled {
+				log.Printf("SAMPLED %s", path)
+			}
+		}
+		infof("Sampled %d of %d entries with -verify-seed %d", len(res.Sampled), res.Entries, res.Seed)
+	}
+	infof("Verified %d entries in %s | Mismatched: %d | Missing: %d | Failed: %d | Mode changed: %d | Unlisted: %d",
+		res.Entries, formatDuration(res.Duration), len(res.Mismatched), len(res.Missing), len(res.Failed), len(res.ModeChanged), len(res.Unlisted))
+	if err != nil {
+		log.Printf("Interrupted, verification incomplete")
+		return exitInterrupted
+	}
+	if reconcile {
+		if !res.Reconciled() {
+			log.Printf("FAIL: the tree and the output do not match")
+			return 1
+		}
+		infof("PASS: every entry matches and every file is listed")
+		return 0
+	}
+	if !res.OK() {
+		return 1
+	}
+	return 0
 }